@@ -2,11 +2,15 @@ package http
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/tferdous17/genesis/utils"
 )
@@ -22,7 +26,11 @@ type Store interface {
 type Cluster interface {
 	Open()
 	Put(key string, value string) error
+	PutWithTTL(key string, value string, ttl time.Duration) error
+	PutIfAbsent(key string, value string) error
+	CompareAndSwap(key string, expectedVersion uint64, newValue string) error
 	Get(key string) (string, error)
+	GetWithVersion(key string) (string, uint64, error)
 	Delete(key string) error
 	AddNode()
 	RemoveNode(addr string)
@@ -134,14 +142,49 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 		}
-		m := map[string]string{}
+		m := map[string]putRequest{}
 		if err := json.Unmarshal(b, &m); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
 
+		// * a conditional write (If-None-Match: * to only create the key, If-Match: "<version>" to only replace that
+		// * version of it) applies to a single key without a TTL
+		ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+		var expectedVersion uint64
+		if ifMatch != "" || ifNoneMatch != "" {
+			if len(m) != 1 || (ifNoneMatch != "" && ifNoneMatch != "*") || (ifMatch != "" && ifNoneMatch != "") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if ifMatch != "" {
+				if expectedVersion, err = parseETag(ifMatch); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		// * every entry is checked before any of them is written, so a bad one can't leave the rest half applied
+		for _, v := range m {
+			if !validTTL(v.TTL) || (v.TTL > 0 && (ifMatch != "" || ifNoneMatch != "")) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
 		for k, v := range m {
-			if err := s.cluster.Put(k, v); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+			switch {
+			case ifNoneMatch != "":
+				err = s.cluster.PutIfAbsent(k, v.Value)
+			case ifMatch != "":
+				err = s.cluster.CompareAndSwap(k, expectedVersion, v.Value)
+			case v.TTL > 0:
+				err = s.cluster.PutWithTTL(k, v.Value, time.Duration(v.TTL)*time.Second)
+			default:
+				err = s.cluster.Put(k, v.Value)
+			}
+			if err != nil {
+				w.WriteHeader(statusFor(err))
 				return
 			}
 		}
@@ -151,11 +194,13 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 		if k == "" {
 			w.WriteHeader(http.StatusBadRequest)
 		}
-		val, err := s.cluster.Get(k)
+		val, version, err := s.cluster.GetWithVersion(k)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		// * the version to send back in If-Match for a compare-and-swap
+		w.Header().Set("ETag", fmt.Sprintf("%q", strconv.FormatUint(version, 10)))
 		_, err = io.WriteString(w, val)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
@@ -177,6 +222,58 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// maxTTLSeconds is the longest TTL a put can ask for, anything longer overflows a time.Duration
+const maxTTLSeconds = math.MaxInt64 / int64(time.Second)
+
+// validTTL reports whether a put can ask for a TTL of ttl seconds (0 for none). Besides fitting in a time.Duration, it
+// has to expire before the store's 32-bit expiry runs out
+func validTTL(ttl int64) bool {
+	if ttl < 0 || ttl > maxTTLSeconds {
+		return false
+	}
+	return ttl == 0 || time.Now().Add(time.Duration(ttl)*time.Second).Unix() < math.MaxUint32
+}
+
+// statusFor maps a failed write to its status code: 409 if a put-if-absent found the key already there, 412 if a
+// compare-and-swap found it at another version, 400 if the TTL is out of range
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, utils.ErrDuplicateKey):
+		return http.StatusConflict
+	case errors.Is(err, utils.ErrConditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, utils.ErrInvalidTTL):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// parseETag reads the version out of an If-Match header, quoted like the ETag it came from or not
+func parseETag(etag string) (uint64, error) {
+	return strconv.ParseUint(strings.Trim(etag, `"`), 10, 64)
+}
+
+// putRequest is the value of a key in a POST /key body, either just the value:
+//
+//	{"user1": "batman"}
+//
+// or the value along with a TTL in seconds, after which the key expires:
+//
+//	{"user1": {"value": "batman", "ttl": 60}}
+type putRequest struct {
+	Value string `json:"value"`
+	TTL   int64  `json:"ttl"`
+}
+
+func (p *putRequest) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &p.Value); err == nil {
+		return nil
+	}
+	type withTTL putRequest // drops the methods, so this doesn't recurse
+	return json.Unmarshal(b, (*withTTL)(p))
+}
+
 func (s *Service) Addr() net.Addr {
 	return s.ln.Addr()
 }
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+)
+
+// BlockCache is a size-bounded LRU cache of decoded SSTable blocks, shared by every table in a store. Blocks are
+// cached after their CRC is checked and they're decompressed, so a hit skips all of that along with the read.
+type BlockCache struct {
+	mu       sync.Mutex
+	capacity int64 // in bytes, measured by the size of the decoded records
+	size     int64
+	entries  map[blockCacheKey]*list.Element
+	lru      *list.List // most recently used at the front
+	hits     uint64
+	misses   uint64
+}
+
+// blockCacheKey identifies a block by its table and where it starts in the table's file
+type blockCacheKey struct {
+	tableNum uint32
+	offset   uint32
+}
+
+type cachedBlock struct {
+	key     blockCacheKey
+	records []Record
+	size    int64
+}
+
+// BlockCacheStats is a snapshot of a BlockCache's counters
+type BlockCacheStats struct {
+	Hits     uint64
+	Misses   uint64
+	Entries  int
+	Size     int64
+	Capacity int64
+}
+
+func NewBlockCache(capacity int64) *BlockCache {
+	return &BlockCache{
+		capacity: capacity,
+		entries:  make(map[blockCacheKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns the block's records and marks it as recently used
+func (c *BlockCache) get(key blockCacheKey) ([]Record, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.entries[key]
+	if !found {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cachedBlock).records, true
+}
+
+// put caches the block's records, evicting the least recently used blocks until everything fits
+func (c *BlockCache) put(key blockCacheKey, records []Record) {
+	var size int64
+	for i := range records {
+		size += int64(records[i].RecordSize)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if size > c.capacity {
+		return
+	}
+	if elem, found := c.entries[key]; found {
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&cachedBlock{key: key, records: records, size: size})
+	c.size += size
+	for c.size > c.capacity {
+		oldest := c.lru.Back()
+		block := oldest.Value.(*cachedBlock)
+		c.lru.Remove(oldest)
+		delete(c.entries, block.key)
+		c.size -= block.size
+	}
+}
+
+func (c *BlockCache) Stats() BlockCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return BlockCacheStats{
+		Hits:     c.hits,
+		Misses:   c.misses,
+		Entries:  len(c.entries),
+		Size:     c.size,
+		Capacity: c.capacity,
+	}
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBlockCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	block := []Record{{Key: "user1", RecordSize: 100}}
+	cache := NewBlockCache(250)
+
+	cache.put(blockCacheKey{tableNum: 1, offset: 0}, block)
+	cache.put(blockCacheKey{tableNum: 1, offset: 4096}, block)
+	// * touch the first block so the second one is the least recently used
+	if _, found := cache.get(blockCacheKey{tableNum: 1, offset: 0}); !found {
+		t.Fatal("expected the first block to be cached")
+	}
+	cache.put(blockCacheKey{tableNum: 2, offset: 0}, block)
+
+	if _, found := cache.get(blockCacheKey{tableNum: 1, offset: 4096}); found {
+		t.Fatal("expected the least recently used block to be evicted")
+	}
+	if _, found := cache.get(blockCacheKey{tableNum: 2, offset: 0}); !found {
+		t.Fatal("expected the newest block to be cached")
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 2 || stats.Size != 200 {
+		t.Fatalf("expected 2 hits, 1 miss and 2 entries of 200 bytes, got %+v", stats)
+	}
+}
+
+func TestDiskStore_GetHitsBlockCache(t *testing.T) {
+	opts := DefaultStoreOptions()
+	opts.FlushSizeThreshold = 1024
+	store, err := openStore(t.TempDir(), t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 40; i++ {
+		key, val := fmt.Sprintf("user%03d", i), fmt.Sprintf("hero%d", i)
+		if err := store.Put(&key, &val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.FlushMemtable(); err != nil {
+		t.Fatal(err)
+	}
+
+	// * user000 was flushed to a table, so the first read misses and every read after that hits
+	for i := 0; i < 3; i++ {
+		if val, err := store.Get("user000"); err != nil || val != "hero0" {
+			t.Fatalf("expected user000 = hero0, got %q (err = %v)", val, err)
+		}
+	}
+	stats := store.BlockCacheStats()
+	if stats.Misses != 1 || stats.Hits != 2 {
+		t.Fatalf("expected 1 miss and 2 hits, got %+v", stats)
+	}
+}
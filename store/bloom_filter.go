@@ -1,83 +1,177 @@
 package store
 
 import (
-	"hash"
+	"encoding/binary"
+	"fmt"
 	"math"
-	"os"
 
 	"github.com/spaolacci/murmur3"
 
 	"github.com/tferdous17/genesis/utils"
 )
 
+// BloomFilter is a table's filter. How it's sized, hashed and what part of a key it holds are picked by the store's
+// FilterPolicy when it's built, and recorded in its header so it can be queried without knowing the policy.
 type BloomFilter struct {
-	file       *os.File
 	bitSetSize uint64
-	bitSet     []bool
-	hashes     []hash.Hash64
+	bitSet     []uint64 // packed, bit i lives in word i/64
+	hashCount  uint64
+	scheme     hashScheme
+	prefixLen  uint32 // 0 if the filter holds whole keys
 }
 
-const p = 0.01 // False positive probability
+// hashScheme names how a filter derives its hash functions, so filters written by an older scheme can still be read
+type hashScheme uint8
 
-func NewBloomFilter(bloomFile *os.File) *BloomFilter {
-	return &BloomFilter{file: bloomFile}
+const (
+	// murmur3SeededScheme hashes keys with 64-bit murmur3, seeded 0 through HashCount-1
+	murmur3SeededScheme hashScheme = 1
+	// doubleHashingScheme hashes keys once with 128-bit murmur3 and derives every bit from its two halves
+	doubleHashingScheme hashScheme = 2
+)
+
+/*
+An encoded bloom filter is laid out as the following:
+
+| BitCount | HashCount | HashScheme | PrefixLength | Bits |
+
+BitCount is 8 bytes, HashCount is 4 bytes, HashScheme is 1 byte and PrefixLength is 4 bytes. The bits follow as
+little-endian 64-bit words, so a filter takes up one bit per bit plus the 17 byte header, and can be decoded without
+knowing how it was built.
+*/
+const bloomFilterHeaderSize = 17
+
+func NewBloomFilter() *BloomFilter {
+	return &BloomFilter{scheme: murmur3SeededScheme}
 }
 
-func (bf *BloomFilter) InitBloomFilterAttrs(numElements uint32) {
-	bf.calculatebitSetSize(numElements)
+// newSizedBloomFilter returns an empty filter with bitsPerKey bits for each of numKeys keys
+func newSizedBloomFilter(numKeys uint32, bitsPerKey float64, scheme hashScheme, prefixLen uint32) *BloomFilter {
+	// proven math formulas to calculate optimal bloom filter params
+	bf := &BloomFilter{
+		bitSetSize: uint64(math.Ceil(float64(max(numKeys, 1)) * bitsPerKey)),
+		hashCount:  max(1, uint64(math.Round(bitsPerKey*math.Ln2))),
+		scheme:     scheme,
+		prefixLen:  prefixLen,
+	}
 	bf.initBitArray()
+	return bf
 }
 
-func (bf *BloomFilter) calculatebitSetSize(numElements uint32) {
-	// proven math formulas to calculate optimal bloom filter params
-	bf.bitSetSize = uint64(math.Ceil(-1 * float64(numElements) * math.Log(p) / math.Pow(math.Log(2), 2)))
-	hashCount := uint64(math.Ceil((float64(bf.bitSetSize) / float64(numElements)) * math.Log(2)))
-	bf.hashes = getHashes(hashCount)
+// Encode returns the filter as stored in an SSTable's filter section, header first
+func (bf *BloomFilter) Encode() []byte {
+	data := make([]byte, bloomFilterHeaderSize+8*len(bf.bitSet))
+	binary.LittleEndian.PutUint64(data[0:8], bf.bitSetSize)
+	binary.LittleEndian.PutUint32(data[8:12], uint32(bf.hashCount))
+	data[12] = byte(bf.scheme)
+	binary.LittleEndian.PutUint32(data[13:17], bf.prefixLen)
+	for i, word := range bf.bitSet {
+		binary.LittleEndian.PutUint64(data[bloomFilterHeaderSize+8*i:], word)
+	}
+	return data
+}
+
+// Load rebuilds the filter from the bytes written by Encode
+func (bf *BloomFilter) Load(data []byte) error {
+	if len(data) < bloomFilterHeaderSize {
+		return fmt.Errorf("bloom filter header is %d bytes, expected %d", len(data), bloomFilterHeaderSize)
+	}
+	bitSetSize := binary.LittleEndian.Uint64(data[0:8])
+	hashCount := binary.LittleEndian.Uint32(data[8:12])
+	scheme := hashScheme(data[12])
+	if scheme != murmur3SeededScheme && scheme != doubleHashingScheme {
+		return fmt.Errorf("unknown bloom filter hash scheme %d", scheme)
+	}
+	if bitSetSize == 0 || hashCount == 0 {
+		return fmt.Errorf("bloom filter has %d bits and %d hashes", bitSetSize, hashCount)
+	}
+	words := data[bloomFilterHeaderSize:]
+	if uint64(len(words)) != 8*numWords(bitSetSize) {
+		return fmt.Errorf("bloom filter of %d bits has %d bytes of bits", bitSetSize, len(words))
+	}
+
+	bf.bitSetSize = bitSetSize
+	bf.hashCount = uint64(hashCount)
+	bf.scheme = scheme
+	bf.prefixLen = binary.LittleEndian.Uint32(data[13:17])
+	bf.bitSet = make([]uint64, numWords(bitSetSize))
+	for i := range bf.bitSet {
+		bf.bitSet[i] = binary.LittleEndian.Uint64(words[8*i:])
+	}
+	return nil
 }
 
 func (bf *BloomFilter) initBitArray() {
-	bf.bitSet = make([]bool, bf.bitSetSize)
+	bf.bitSet = make([]uint64, numWords(bf.bitSetSize))
 }
 
-func (bf *BloomFilter) Add(key string) error {
-	for _, hash64 := range bf.hashes {
-		hash64.Reset()
-		_, err := hash64.Write([]byte(key))
-		if err != nil {
-			return err
-		}
-		hashValue := hash64.Sum64() % bf.bitSetSize
-		bf.bitSet[hashValue] = true
-	}
+// numWords is how many 64-bit words it takes to hold bits
+func numWords(bits uint64) uint64 {
+	return (bits + 63) / 64
+}
 
+func (bf *BloomFilter) Add(key string) error {
+	bf.forEachBit(bf.filterKey(key), func(bit uint64) bool {
+		bf.bitSet[bit/64] |= 1 << (bit % 64)
+		return true
+	})
 	return nil
 }
 
 func (bf *BloomFilter) MightContain(key string) bool {
 	// ! Bloom filter is probabilistic, so there's a chance to get false positives
-	for _, hasher := range bf.hashes {
-		hasher.Reset()
-		_, err := hasher.Write([]byte(key))
-		if err != nil {
-			return false
-		}
-		hashValue := hasher.Sum64() % bf.bitSetSize
-		if !bf.bitSet[hashValue] {
-			return false
-		}
+	return bf.mightContain(bf.filterKey(key))
+}
+
+// MightContainPrefix reports whether any key starting with prefix may be in the filter. Only prefix filters can rule
+// anything out, and only for prefixes at least as long as the ones they hold.
+func (bf *BloomFilter) MightContainPrefix(prefix string) bool {
+	if bf.prefixLen == 0 || uint32(len(prefix)) < bf.prefixLen {
+		return true
+	}
+	return bf.mightContain(prefix[:bf.prefixLen])
+}
+
+func (bf *BloomFilter) mightContain(filterKey string) bool {
+	found := true
+	bf.forEachBit(filterKey, func(bit uint64) bool {
+		found = bf.bitSet[bit/64]&(1<<(bit%64)) != 0
+		return found
+	})
+	return found
+}
+
+// filterKey is the part of key the filter holds, keys shorter than the prefix length are held whole
+func (bf *BloomFilter) filterKey(key string) string {
+	if bf.prefixLen > 0 && uint32(len(key)) > bf.prefixLen {
+		return key[:bf.prefixLen]
 	}
-	return true
+	return key
 }
 
-func getHashes(k uint64) []hash.Hash64 {
-	hashers := make([]hash.Hash64, k)
-	for i := 0; uint64(i) < k; i++ {
-		hashers[i] = murmur3.New64WithSeed(uint32(i))
+// forEachBit calls fn with every bit filterKey maps to, until fn returns false
+func (bf *BloomFilter) forEachBit(filterKey string, fn func(bit uint64) bool) {
+	data := []byte(filterKey)
+	switch bf.scheme {
+	case murmur3SeededScheme:
+		for seed := uint64(0); seed < bf.hashCount; seed++ {
+			if !fn(murmur3.Sum64WithSeed(data, uint32(seed)) % bf.bitSetSize) {
+				return
+			}
+		}
+	case doubleHashingScheme:
+		// * Kirsch-Mitzenmacher: the i-th hash is h1 + i*h2, which is as good as i independent hashes
+		h1, h2 := murmur3.Sum128(data)
+		for i := uint64(0); i < bf.hashCount; i++ {
+			if !fn((h1 + i*h2) % bf.bitSetSize) {
+				return
+			}
+		}
 	}
-	return hashers
 }
 
 func (bf *BloomFilter) Debug() {
 	utils.LogCYAN("Bit Set: %v", bf.bitSet)
 	utils.LogCYAN("Bit Set Size: %d", bf.bitSetSize)
+	utils.LogCYAN("Hash Count: %d", bf.hashCount)
 }
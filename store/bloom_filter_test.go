@@ -0,0 +1,138 @@
+package store
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestBloomFilter_EncodeAndLoad(t *testing.T) {
+	for _, policy := range []FilterPolicy{NewBloomFilterPolicy(10), NewDoubleHashingFilterPolicy(10), NewPrefixBloomFilterPolicy(6, 10)} {
+		bf := policy.NewFilter(1000)
+		for i := 0; i < 1000; i++ {
+			if err := bf.Add(fmt.Sprintf("user%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// * one bit per bit, rounded up to whole words, plus the header
+		data := bf.Encode()
+		if expected := bloomFilterHeaderSize + 8*int(numWords(bf.bitSetSize)); len(data) != expected {
+			t.Fatalf("%s: expected a %d byte filter for %d bits, got %d bytes", policy.Name(), expected, bf.bitSetSize, len(data))
+		}
+
+		loaded := NewBloomFilter()
+		if err := loaded.Load(data); err != nil {
+			t.Fatal(err)
+		}
+		if loaded.bitSetSize != bf.bitSetSize || loaded.hashCount != bf.hashCount || loaded.scheme != bf.scheme ||
+			loaded.prefixLen != bf.prefixLen || !slices.Equal(loaded.bitSet, bf.bitSet) {
+			t.Fatalf("%s: expected %d bits and %d hashes, got %d bits and %d hashes", policy.Name(), bf.bitSetSize, bf.hashCount, loaded.bitSetSize, loaded.hashCount)
+		}
+		for i := 0; i < 1000; i++ {
+			if !loaded.MightContain(fmt.Sprintf("user%d", i)) {
+				t.Fatalf("%s: expected the loaded filter to contain user%d", policy.Name(), i)
+			}
+		}
+	}
+
+	data := DefaultFilterPolicy.NewFilter(10).Encode()
+	unknownScheme := slices.Clone(data)
+	unknownScheme[12] = 0xFF
+	if err := NewBloomFilter().Load(unknownScheme); err == nil {
+		t.Fatal("expected an unknown hash scheme to be rejected")
+	}
+	if err := NewBloomFilter().Load(data[:len(data)-8]); err == nil {
+		t.Fatal("expected a truncated filter to be rejected")
+	}
+}
+
+func TestBloomFilter_FalsePositiveRate(t *testing.T) {
+	for _, policy := range []FilterPolicy{NewBloomFilterPolicy(10), NewDoubleHashingFilterPolicy(10)} {
+		bf := policy.NewFilter(10000)
+		for i := 0; i < 10000; i++ {
+			if err := bf.Add(fmt.Sprintf("user%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// * 10 bits per key should land around 1%
+		falsePositives := 0
+		for i := 0; i < 10000; i++ {
+			if bf.MightContain(fmt.Sprintf("hero%d", i)) {
+				falsePositives++
+			}
+		}
+		if falsePositives > 200 {
+			t.Fatalf("%s: expected about 100 false positives out of 10000, got %d", policy.Name(), falsePositives)
+		}
+	}
+}
+
+func TestBloomFilter_Prefix(t *testing.T) {
+	bf := NewPrefixBloomFilterPolicy(4, 10).NewFilter(100)
+	for i := 0; i < 100; i++ {
+		if err := bf.Add(fmt.Sprintf("user%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !bf.MightContainPrefix("user") || !bf.MightContainPrefix("user4") || !bf.MightContain("user42") {
+		t.Fatal("expected keys starting with user to pass the filter")
+	}
+	if bf.MightContainPrefix("hero") || bf.MightContainPrefix("hero1") {
+		t.Fatal("expected keys starting with hero to be ruled out")
+	}
+	// * prefixes shorter than the filter's can't be checked
+	if !bf.MightContainPrefix("he") {
+		t.Fatal("expected a prefix shorter than the filter's to pass")
+	}
+}
+
+func TestDiskStore_ScanPrefixSkipsFilteredTables(t *testing.T) {
+	opts := DefaultStoreOptions()
+	opts.FilterPolicy = NewPrefixBloomFilterPolicy(4, 10)
+	store, err := openStore(t.TempDir(), t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// * the user keys go into one table and the hero keys into another
+	for _, prefix := range []string{"user", "hero"} {
+		for i := 0; i < 30; i++ {
+			key, val := fmt.Sprintf("%s%03d", prefix, i), fmt.Sprintf("value%d", i)
+			if err := store.Put(&key, &val); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.FlushMemtable(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	skipped := 0
+	for _, table := range store.bucketManager.tablesNewestFirst() {
+		if !table.bloomFilter.MightContainPrefix("user") {
+			skipped++
+		}
+	}
+	if skipped == 0 {
+		t.Fatal("expected the hero tables' filters to rule out the user prefix")
+	}
+
+	it, err := store.ScanPrefix("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	count := 0
+	for ; it.Valid(); it.Next() {
+		if expected := fmt.Sprintf("user%03d", count); it.Key() != expected {
+			t.Fatalf("expected %s, got %s", expected, it.Key())
+		}
+		count++
+	}
+	if err := it.Error(); err != nil || count != 30 {
+		t.Fatalf("expected 30 user keys, got %d (err = %v)", count, err)
+	}
+}
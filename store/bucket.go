@@ -1,13 +1,7 @@
 package store
 
 import (
-	"cmp"
-	"container/heap"
-	"errors"
-	"fmt"
-	"io"
 	"os"
-	"slices"
 
 	"github.com/tferdous17/genesis/utils"
 )
@@ -51,194 +45,78 @@ func (b *Bucket) AdjustSizeThresholdParams(bucketLow, bucketHigh float32) {
 	b.bucketHigh = bucketHigh
 }
 
+// AppendTableToBucket adds the table to this bucket, the size-tiered strategy decides which bucket a table belongs in
 func (b *Bucket) AppendTableToBucket(table *SSTable) {
-	if table.sizeInBytes < b.minTableSize {
-		return
-	}
-
-	if len(b.tables) == 0 {
-		b.tables = append(b.tables, *table)
-		b.calculateAvgBucketSize()
-		return
-	}
+	b.tables = append(b.tables, *table)
 
-	lowerSizeThreshold := uint32(b.bucketLow * float32(b.avgBucketSize))   // 50% lower than avg size
-	higherSizeThreshold := uint32(b.bucketHigh * float32(b.avgBucketSize)) // 50% higher than avg size
+	//update avg size on each append
+	b.calculateAvgBucketSize()
+}
 
-	if lowerSizeThreshold <= table.sizeInBytes && table.sizeInBytes <= higherSizeThreshold {
+// appendRun adds every table of a run to this bucket
+func (b *Bucket) appendRun(run []*SSTable) {
+	for _, table := range run {
 		b.tables = append(b.tables, *table)
-	} else {
-		utils.Log("Could not append table. Out of range")
 	}
-
-	//update avg size on each append
 	b.calculateAvgBucketSize()
 }
 
+// calculateAvgBucketSize averages the size of the bucket's runs, since the tables a compaction split its output into
+// only make up one run's worth between them
 func (b *Bucket) calculateAvgBucketSize() {
+	runs := b.runs()
+	if len(runs) == 0 {
+		b.avgBucketSize = b.minTableSize
+		return
+	}
+
 	var sum uint32 = 0
 	for i := range b.tables {
 		sum += b.tables[i].sizeInBytes
 	}
-	b.avgBucketSize = sum / uint32(len(b.tables))
+	b.avgBucketSize = sum / uint32(len(runs))
 }
 
 func (b *Bucket) NeedsCompaction(minNumTables, maxNumTables int) bool {
-	return len(b.tables) >= minNumTables && len(b.tables) <= maxNumTables
+	runs := b.runs()
+	return len(runs) >= minNumTables && len(runs) <= maxNumTables
 }
 
-func (b *Bucket) TriggerCompaction() (*SSTable, error) {
-	utils.LogGREEN("STARTING COMPACTION WITH LENGTH %d", len(b.tables))
-
-	var allSortedRuns [][]Record
-
+// runs groups the bucket's tables by the flush or compaction that wrote them, in the order they were added
+func (b *Bucket) runs() [][]*SSTable {
+	var runs [][]*SSTable
+	index := make(map[uint32]int)
 	for i := range b.tables {
-		var currSortedRun []Record
-		var currOffset uint32
-
-		// Set seek 0 to for every table otherwise the seek position will be at the end of each file by default
-		// I assume because of previous reading done on said files?
-		_, err := b.tables[i].dataFile.Seek(int64(currOffset), 0)
-		if err != nil {
-			return nil, err
-		}
-		for {
-			currEntry := make([]byte, headerSize)
-			_, err := io.ReadFull(b.tables[i].dataFile, currEntry)
-			if errors.Is(err, io.EOF) {
-				//utils.Log("END OF FILE")
-				break
-			}
-
-			h := &Header{}
-			err = h.DecodeHeader(currEntry)
-			if err != nil {
-				return nil, err
-			}
-
-			// * move the cursor so we can read the rest of the record
-			currOffset += headerSize // can do this since headerSize is constant
-			_, err = b.tables[i].dataFile.Seek(int64(currOffset), 0)
-			if err != nil {
-				return nil, err
-			}
-			// * set up []byte for the rest of the record
-			currRecord := make([]byte, h.KeySize+h.ValueSize)
-			if _, err := io.ReadFull(b.tables[i].dataFile, currRecord); err != nil {
-				fmt.Println("READFULL ERR:", err)
-				break
-			}
-			// * append both []byte together in order to decode as a whole
-			currEntry = append(currEntry, currRecord...) // full size of the record
-			r := &Record{}
-			err = r.DecodeKV(currEntry)
-			if err != nil {
-				return nil, err
-			}
-
-			currSortedRun = append(currSortedRun, *r)
-
-			currOffset += r.Header.KeySize + r.Header.ValueSize
-			_, err = b.tables[i].dataFile.Seek(int64(currOffset), 0)
-			if err != nil {
-				return nil, err
-			}
+		id := runID(&b.tables[i])
+		j, found := index[id]
+		if !found {
+			j = len(runs)
+			index[id] = j
+			runs = append(runs, nil)
 		}
-		allSortedRuns = append(allSortedRuns, currSortedRun)
-	}
-
-	// * now we have all our sorted runs
-	h := MinRecordHeap{}
-	for i := range allSortedRuns {
-		for j := range allSortedRuns[i] {
-			heap.Push(&h, allSortedRuns[i][j])
-		}
-	}
-
-	// * now that they're all in a heap, we need to throw it into 1 big sstable
-	utils.LogGREEN("Heap len = %d", h.Len())
-	finalSortedRun := make([]Record, 0)
-	for h.Len() > 0 {
-		ele := heap.Pop(&h)
-		finalSortedRun = append(finalSortedRun, ele.(Record))
+		runs[j] = append(runs[j], &b.tables[i])
 	}
-
-	filterAndDeleteTombstones(&finalSortedRun)
-	removeOutdatedEntires(&finalSortedRun)
-
-	// once the new merged table gets created, we add it to a new bucket
-	mergedSSTable, err := InitSSTableOnDisk("storage", &finalSortedRun)
-	if err != nil {
-		return nil, err
-	}
-
-	// ! now we need to delete the old sstables from disk to free up space
-	err = deleteOldSSTables(&b.tables)
-	if err != nil {
-		return nil, err
-	}
-
-	return mergedSSTable, nil
+	return runs
 }
 
-func filterAndDeleteTombstones(sortedRun *[]Record) {
-	var collectedTombstones []string
-
-	// collect all tombstones to delete
-	for i := range *sortedRun {
-		if (*sortedRun)[i].Header.Tombstone == 1 {
-			collectedTombstones = append(collectedTombstones, (*sortedRun)[i].Key)
-		}
-	}
-
-	// now look at every key in collectedTombstones and delete it from the sorted run
-	for i := 0; i < len(*sortedRun); {
-		if slices.Contains(collectedTombstones, (*sortedRun)[i].Key) {
-			if i < len(*sortedRun)-1 {
-				*sortedRun = slices.Delete(*sortedRun, i, i+1)
-			} else {
-				*sortedRun = (*sortedRun)[:len(*sortedRun)-1]
-			}
-		} else {
-			i++
-		}
-	}
-}
-
-func removeOutdatedEntires(sortedRun *[]Record) {
-	// * take every entry -> append to a map, if value for a given map key is > 1,
-	// * then sort the value (which will be a slice) & delete all values except the last 1 in the overall slice
-
-	var tempMap = make(map[string][]Record)
-
-	for i := range *sortedRun {
-		tempMap[(*sortedRun)[i].Key] = append(tempMap[(*sortedRun)[i].Key], (*sortedRun)[i])
-	}
-
-	for _, v := range tempMap {
-		if len(v) > 1 {
-			slices.SortFunc(v, func(a, b Record) int {
-				return cmp.Compare(a.Header.TimeStamp, b.Header.TimeStamp)
-			})
-
-			for i := 0; i < len(v)-1; i++ {
-				idx := slices.Index(*sortedRun, v[i])
-				*sortedRun = slices.Delete(*sortedRun, idx, idx+1)
-			}
-		}
+// runID identifies the run a table belongs to: a flushed table is one of its own, while every table a compaction
+// split its output into shares the first one's number
+func runID(table *SSTable) uint32 {
+	if table.run != 0 {
+		return table.run
 	}
+	return table.sstCounter
 }
 
+// deleteOldSSTables deletes the files of tables that were swapped out and drops the BucketManager's reference to them,
+// so each file is closed as soon as the last reader still holding the table is done with it
 func deleteOldSSTables(tables *[]SSTable) error {
 	for i := range *tables {
-		files := []string{(*tables)[i].dataFile.Name(), (*tables)[i].indexFile.Name(), (*tables)[i].bloomFilter.file.Name()}
-
-		for _, file := range files {
-			if err := os.Remove(file); err != nil {
-				utils.Log("DELETION ERROR")
-				return err
-			}
+		if err := os.Remove((*tables)[i].file.Name()); err != nil {
+			utils.Log("DELETION ERROR")
+			return err
 		}
+		(*tables)[i].unref()
 	}
 	*tables = []SSTable{} // empty the slice
 	return nil
@@ -1,107 +1,284 @@
 package store
 
 import (
+	"cmp"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
 	"github.com/tferdous17/genesis/utils"
 )
 
+// BucketManager owns a store's SSTables: their files, the manifest recording them and the block cache they share.
+// Which level each table lives at and when tables get merged is up to its CompactionStrategy, and the merges
+// themselves run on background goroutines, at most maxCompactions at a time.
 type BucketManager struct {
-	buckets           map[int]*Bucket // maybe make map?
-	highestLvl        int
-	minTableThreshold int
-	maxTableThreshold int
+	mu             sync.Mutex // guards the strategy's tables and the compactions running against them
+	strategy       CompactionStrategy
+	running        []*compaction
+	maxCompactions int
+	// tombstones younger than this are never garbage collected
+	tombstoneGracePeriod time.Duration
+	closed               bool
+	started              bool           // compactions are only scheduled once the store is fully open, see start
+	wg                   sync.WaitGroup // tracks running compactions
+	directory            string         // where this store's SSTables live
+	manifest             *manifest      // records every table added or removed
+	compression          Compression    // codec for the data blocks of new tables
+	filterPolicy         FilterPolicy   // builds the filters of new tables
+	blockCache           *BlockCache    // shared by every table, nil if caching is disabled
 }
 
-// InitBucketManager Initializes manager + first level of buckets
+// InitBucketManager Initializes manager + first level of buckets, arranged size-tiered
 func InitBucketManager() *BucketManager {
-	manager := &BucketManager{
-		buckets:           make(map[int]*Bucket),
-		highestLvl:        1,
-		minTableThreshold: 4,
-		maxTableThreshold: 12,
+	return &BucketManager{strategy: newSizeTieredCompaction(FlushSizeThreshold, 0), maxCompactions: 1, started: true}
+}
+
+// openBucketManager rebuilds the manager from the tables the manifest says are live, handing each one back to the
+// store's compaction strategy at the level it was recorded at. No compaction runs until start is called.
+func openBucketManager(directory string, manifest *manifest, opts StoreOptions) (*BucketManager, error) {
+	bm := &BucketManager{
+		strategy:             newCompactionStrategy(opts),
+		maxCompactions:       max(1, opts.MaxBackgroundCompactions),
+		tombstoneGracePeriod: opts.TombstoneGracePeriod,
+		directory:            directory,
+		manifest:             manifest,
+		compression:          opts.Compression,
+		filterPolicy:         opts.FilterPolicy,
+	}
+	if opts.BlockCacheSize > 0 {
+		bm.blockCache = NewBlockCache(opts.BlockCacheSize)
+	}
+
+	for _, meta := range manifest.liveTables() {
+		table, err := loadSSTable(directory, meta)
+		if err != nil {
+			return nil, err
+		}
+		table.cache = bm.blockCache
+		bm.strategy.restoreTable(table, meta.level)
 	}
-	manager.buckets[1] = InitEmptyBucket()
 
-	return manager
+	return bm, nil
+}
+
+// start lets compactions run, once the store has read everything it needs from the manifest and replayed its WAL
+func (bm *BucketManager) start() {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	// * a strategy may have restored tables somewhere other than where they were recorded (or been switched to from
+	// * another one), so whatever needs compacting is scheduled right away
+	bm.started = true
+	bm.scheduleCompactions()
 }
 
+// InsertTable adds a freshly flushed table to the manager and records it in the manifest. Any compaction it makes
+// necessary is scheduled in the background, so InsertTable never waits on a merge.
 func (bm *BucketManager) InsertTable(table *SSTable) error {
-	var levelToAppend = 1
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	table.cache = bm.blockCache
+	levelToAppend := bm.strategy.addTable(table)
+	if err := bm.logEdit(&versionEdit{added: []tableMeta{newTableMeta(table, levelToAppend)}}); err != nil {
+		return err
+	}
+	bm.scheduleCompactions()
+
+	bm.DebugBM()
+	return nil
+}
+
+// RetrieveKey returns the newest version (highest sequence number) of key across every table.
+// Returns utils.ErrKeyNotFound if no table has it or the newest version is a tombstone or expired.
+func (bm *BucketManager) RetrieveKey(key *string) (string, error) {
+	newest, err := bm.newestRecord(*key)
+	if err != nil {
+		return "<!>", err
+	}
+	if newest == nil || newest.Header.deleted(uint32(time.Now().Unix())) {
+		return "<!not_found>", utils.ErrKeyNotFound
+	}
+	return newest.Value, nil
+}
 
-	for currLvl := bm.highestLvl; currLvl > 0; currLvl-- {
-		bkt := bm.buckets[currLvl]
+// newestRecord returns the newest version of key across every table (tombstones included), or nil if no table has it
+func (bm *BucketManager) newestRecord(key string) (*Record, error) {
+	tables := bm.tablesNewestFirst()
+	defer releaseTables(tables)
 
-		calculatedLevelReturn := calculateLevel(bkt, table)
-		levelToAppend = currLvl + calculatedLevelReturn
+	var newest *Record
+	for _, table := range tables {
+		// * compacted tables can span the sequence numbers of other tables, so a table can't just be trusted because
+		// * it's searched first. once a table's newest record is older than the best match, though, none of the
+		// * remaining ones can beat it either
+		if newest != nil && table.maxSeqNum < newest.Header.SeqNum {
+			break
+		}
 
-		if calculatedLevelReturn == -1 {
+		// * getRecord skips tables using their key range and bloom filter
+		record, err := table.getRecord(key)
+		if errors.Is(err, utils.ErrKeyNotWithinTable) {
 			continue
+		} else if err != nil {
+			return nil, err
 		}
-
-		if calculatedLevelReturn == 0 {
-			bm.buckets[currLvl].AppendTableToBucket(table)
-		} else { // calculatedLevelReturn == 1
-			bm.buckets[levelToAppend] = InitEmptyBucket()
-			bm.buckets[levelToAppend].AppendTableToBucket(table)
-			bm.highestLvl++
+		if newest == nil || record.Header.SeqNum > newest.Header.SeqNum {
+			newest = record
 		}
-		break
 	}
+	return newest, nil
+}
 
-	if bm.shouldCompact(levelToAppend) {
-		err := bm.compact(levelToAppend)
-		if err != nil {
-			return err
+// tablesNewestFirst returns every table across all levels, ordered by their highest sequence number, newest first.
+// Compactions swap tables out but never modify them, and every table is returned with a reference taken, so the
+// tables stay readable after a swap (their files stay open even once they're deleted) until the caller hands them
+// to releaseTables.
+func (bm *BucketManager) tablesNewestFirst() []*SSTable {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	var tables []*SSTable
+	for _, level := range bm.strategy.levels() {
+		for _, table := range level {
+			// * the tables of a closed manager are already released
+			if table.ref() {
+				tables = append(tables, table)
+			}
 		}
 	}
-
-	bm.DebugBM()
-	return nil
+	slices.SortFunc(tables, func(a, b *SSTable) int {
+		return cmp.Compare(b.maxSeqNum, a.maxSeqNum)
+	})
+	return tables
 }
 
-func (bm *BucketManager) RetrieveKey(key *string) (string, error) {
-	// start at highest level first
-	for lvl := bm.highestLvl; lvl > 0; lvl-- {
-		for _, table := range bm.buckets[lvl].tables {
-			return table.Get(*key)
-		}
+// releaseTables drops the references taken by tablesNewestFirst
+func releaseTables(tables []*SSTable) {
+	for _, table := range tables {
+		table.unref()
 	}
-	return "<!not_found>", utils.ErrKeyNotFound
 }
 
 func (bm *BucketManager) DebugBM() {
-	utils.Log("Length of each bucket:")
-	for k, v := range bm.buckets {
-		utils.LogCYAN("Level = %d, Len of level = %d", k, len(v.tables))
+	utils.Log("Length of each level:")
+	for k, v := range bm.strategy.levels() {
+		utils.LogCYAN("Level = %d, Len of level = %d", k, len(v))
+	}
+}
+
+// scheduleCompactions starts every compaction the strategy picks, until maxCompactions are running. Requires bm.mu
+func (bm *BucketManager) scheduleCompactions() {
+	for bm.started && !bm.closed && len(bm.running) < bm.maxCompactions {
+		c := bm.strategy.pickCompaction(bm.running)
+		if c == nil {
+			return
+		}
+		bm.prepareTombstoneGC(c)
+		bm.running = append(bm.running, c)
+		bm.wg.Add(1)
+		go bm.runCompaction(c)
 	}
 }
 
-func (bm *BucketManager) compact(level int) error {
-	bkt := bm.buckets[level]
-	mergedTable, err := bkt.TriggerCompaction() // ONLY triggers if threshold is reached in the bucket
+// prepareTombstoneGC works out which tombstones the compaction may drop. Every table outside the inputs that overlaps
+// them and has records older than theirs could hold a version a dropped tombstone would bring back. Tables written
+// later (or compacted concurrently) only ever hold newer versions or copies of these ones, so checking against this
+// snapshot stays safe for the whole compaction. Requires bm.mu
+func (bm *BucketManager) prepareTombstoneGC(c *compaction) {
+	inputs := busyTables([]*compaction{c})
+	minKey, maxKey := keyRange(c.inputs)
+	var maxSeqNum uint64
+	for _, table := range c.inputs {
+		maxSeqNum = max(maxSeqNum, table.maxSeqNum)
+	}
 
-	if mergedTable != nil {
-		err := bm.InsertTable(mergedTable)
-		if err != nil {
-			return err
+	for _, level := range bm.strategy.levels() {
+		for _, table := range level {
+			if !inputs[table.sstCounter] && table.overlaps(minKey, maxKey) && table.minSeqNum < maxSeqNum {
+				c.olderTables = append(c.olderTables, table)
+			}
 		}
 	}
+	c.tombstoneCutoff = uint32(time.Now().Add(-bm.tombstoneGracePeriod).Unix())
+}
 
-	return err
+// runCompaction merges the compaction's inputs without holding bm.mu, so flushes and reads carry on meanwhile, then
+// swaps the merged table in and schedules whatever the swap made necessary
+func (bm *BucketManager) runCompaction(c *compaction) {
+	defer bm.wg.Done()
+
+	mergedTables, err := mergeTables(c, bm.directory, bm.allocateTableNum, bm.compression, bm.filterPolicy)
+
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	bm.running = slices.DeleteFunc(bm.running, func(other *compaction) bool {
+		return other == c
+	})
+	if err == nil {
+		err = bm.swapTables(c, mergedTables)
+	}
+	if err != nil {
+		// * the inputs are left as they were, so the compaction gets picked again once the next table comes in
+		utils.LogRED("compaction failed: %s", err.Error())
+		return
+	}
+	bm.scheduleCompactions()
 }
 
-func (bm *BucketManager) shouldCompact(level int) bool {
-	return bm.buckets[level].NeedsCompaction(bm.minTableThreshold, bm.maxTableThreshold)
+// swapTables replaces the compaction's inputs with the merged tables. Requires bm.mu
+func (bm *BucketManager) swapTables(c *compaction, mergedTables []*SSTable) error {
+	// * swap the old tables out for the merged ones in a single manifest edit, so a crash leaves either all the old
+	// * tables or the merged tables live, never both or neither
+	oldTables := make([]SSTable, 0, len(c.inputs))
+	edit := &versionEdit{}
+	for _, table := range c.inputs {
+		oldTables = append(oldTables, *table)
+		edit.removed = append(edit.removed, table.sstCounter)
+	}
+	for _, table := range mergedTables {
+		table.cache = bm.blockCache
+	}
+	mergedLevels := bm.strategy.finishCompaction(c, mergedTables)
+	for i, table := range mergedTables {
+		edit.added = append(edit.added, newTableMeta(table, mergedLevels[i]))
+	}
+	if err := bm.logEdit(edit); err != nil {
+		return err
+	}
+
+	// ! now we need to delete the old sstables from disk to free up space
+	return deleteOldSSTables(&oldTables)
 }
 
-func calculateLevel(bucket *Bucket, table *SSTable) int {
-	lowerSizeThreshold := uint32(bucket.bucketLow * float32(bucket.avgBucketSize))   // 50% lower than avg size
-	higherSizeThreshold := uint32(bucket.bucketHigh * float32(bucket.avgBucketSize)) // 50% higher than avg size
+// waitForCompactions blocks until every scheduled compaction, including the ones they go on to schedule, is done
+func (bm *BucketManager) waitForCompactions() {
+	bm.wg.Wait()
+}
 
-	if table.sizeInBytes < lowerSizeThreshold {
-		return -1
-	} else if table.sizeInBytes > higherSizeThreshold {
-		return 1
-	} else {
-		return 0
+// close stops scheduling new compactions, waits for the running ones to finish, releases every live table (whose files
+// close once any iterators still reading them are closed too) and closes the manifest
+func (bm *BucketManager) close() error {
+	bm.mu.Lock()
+	bm.closed = true
+	bm.mu.Unlock()
+
+	bm.waitForCompactions()
+
+	bm.mu.Lock()
+	for _, level := range bm.strategy.levels() {
+		releaseTables(level)
 	}
+	bm.mu.Unlock()
+	return bm.manifest.close()
+}
+
+func (bm *BucketManager) allocateTableNum() uint32 {
+	return bm.manifest.allocateTableNum()
+}
+
+func (bm *BucketManager) logEdit(edit *versionEdit) error {
+	return bm.manifest.logEdit(edit)
 }
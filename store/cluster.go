@@ -30,6 +30,7 @@ type Cluster struct {
 	hashRing    *hashring.HashRing
 	nodes       map[string]*Node
 	accumulator *dataMigrationAccumulator
+	storeOpts   StoreOptions
 }
 
 var nodeCounter uint32 = 1
@@ -42,7 +43,7 @@ func (c *Cluster) initNodes(numOfNodes uint32) {
 	var nodeAddrs []string
 
 	for i := 0; i < int(numOfNodes); i++ {
-		store, _ := newStore(nodeCounter)
+		store, _ := newStore(nodeCounter, c.storeOpts)
 		node := Node{
 			ID:    fmt.Sprintf("node-%d", nodeCounter),
 			Addr:  fmt.Sprintf(":%d", currentNodePort),
@@ -63,7 +64,7 @@ func (c *Cluster) initNodes(numOfNodes uint32) {
 
 func (c *Cluster) AddNode() {
 	fmt.Println("adding new node @ address", currentNodePort)
-	store, _ := newStore(nodeCounter)
+	store, _ := newStore(nodeCounter, c.storeOpts)
 	node := Node{
 		ID:    fmt.Sprintf("node-%d", nodeCounter),
 		Addr:  fmt.Sprintf(":%d", currentNodePort),
@@ -117,13 +118,14 @@ func (c *Cluster) Open() {
 	if err != nil {
 		fmt.Println(err)
 	}
-
+	c.Close()
 }
 
 func (c *Cluster) Close() {
 	fmt.Println("Closing entire cluster..")
 	for _, node := range c.nodes {
 		node.server.GracefulStop()
+		node.Store.Close()
 	}
 }
 
@@ -140,6 +142,20 @@ func (c *Cluster) Put(key, value string) error {
 	return nil
 }
 
+// PutWithTTL stores the key, value pair on the node owning key, where it expires after ttl
+func (c *Cluster) PutWithTTL(key, value string, ttl time.Duration) error {
+	nodeAddr, _ := c.hashRing.GetNode(key) // get which node this key should be on
+	fmt.Printf("key = %s\t", key)
+	fmt.Printf("added @ node addr = %s with ttl = %s\n", nodeAddr, ttl)
+
+	node, ok := c.nodes[nodeAddr]
+
+	if ok {
+		return node.Store.PutWithTTL(&key, &value, ttl)
+	}
+	return nil
+}
+
 func (c *Cluster) Get(key string) (string, error) {
 	fmt.Printf("key = %s\t", key)
 	nodeAddr, _ := c.hashRing.GetNode(key) // get which node this key should be on
@@ -153,6 +169,42 @@ func (c *Cluster) Get(key string) (string, error) {
 	return "", nil
 }
 
+// GetWithVersion returns the value of key along with its version, see DiskStore.GetWithVersion
+func (c *Cluster) GetWithVersion(key string) (string, uint64, error) {
+	nodeAddr, _ := c.hashRing.GetNode(key) // get which node this key should be on
+	node, ok := c.nodes[nodeAddr]
+
+	if ok {
+		return node.Store.GetWithVersion(key)
+	}
+
+	return "", 0, nil
+}
+
+// CompareAndSwap stores newValue under key only if the key is still at expectedVersion, see DiskStore.CompareAndSwap
+func (c *Cluster) CompareAndSwap(key string, expectedVersion uint64, newValue string) error {
+	nodeAddr, _ := c.hashRing.GetNode(key) // get which node this key should be on
+	node, ok := c.nodes[nodeAddr]
+
+	if ok {
+		fmt.Printf("compare-and-swap %s @ node addr = %s\n", key, nodeAddr)
+		return node.Store.CompareAndSwap(key, expectedVersion, newValue)
+	}
+	return nil
+}
+
+// PutIfAbsent stores the key, value pair only if the key is missing, see DiskStore.PutIfAbsent
+func (c *Cluster) PutIfAbsent(key string, value string) error {
+	nodeAddr, _ := c.hashRing.GetNode(key) // get which node this key should be on
+	node, ok := c.nodes[nodeAddr]
+
+	if ok {
+		fmt.Printf("put-if-absent %s @ node addr = %s\n", key, nodeAddr)
+		return node.Store.PutIfAbsent(key, value)
+	}
+	return nil
+}
+
 func (c *Cluster) Delete(key string) error {
 	nodeAddr, _ := c.hashRing.GetNode(key) // get which node this key should be on
 	node, ok := c.nodes[nodeAddr]
@@ -263,7 +315,9 @@ func convertProtoRecordToStoreRecord(record *proto.Record) *Record {
 		Header: Header{
 			CheckSum:  record.Header.Checksum,
 			Tombstone: uint8(record.Header.Tombstone),
+			SeqNum:    record.Header.SeqNum,
 			TimeStamp: record.Header.Timestamp,
+			ExpiresAt: record.Header.ExpiresAt,
 			KeySize:   record.Header.KeySize,
 			ValueSize: record.Header.ValueSize,
 		},
@@ -281,7 +335,9 @@ func convertRecordsToProtoKVPairs(records *[]Record) []*proto.KVPair {
 				Header: &proto.Header{
 					Checksum:  rec.Header.CheckSum,
 					Tombstone: uint32(rec.Header.Tombstone),
+					SeqNum:    rec.Header.SeqNum,
 					Timestamp: rec.Header.TimeStamp,
+					ExpiresAt: rec.Header.ExpiresAt,
 					KeySize:   rec.Header.KeySize,
 					ValueSize: rec.Header.ValueSize,
 				},
@@ -0,0 +1,244 @@
+package store
+
+import (
+	"container/heap"
+	"os"
+	"time"
+
+	"github.com/tferdous17/genesis/utils"
+)
+
+// CompactionStyle picks the CompactionStrategy a store arranges its tables with
+type CompactionStyle int
+
+const (
+	// SizeTieredCompaction groups tables of similar size into buckets and merges a bucket once it holds enough of
+	// them (based off Apache Cassandra). Cheap on writes, but a key can have a version in every bucket.
+	SizeTieredCompaction CompactionStyle = iota
+	// LeveledCompaction keeps every level past the first a sorted run of non-overlapping tables, each level
+	// LevelSizeMultiplier times bigger than the one before it (based off LevelDB). Rewrites more data, but a key has
+	// at most one version per level, so reads and space amplification stay low.
+	LeveledCompaction
+)
+
+func (s CompactionStyle) String() string {
+	switch s {
+	case SizeTieredCompaction:
+		return "size-tiered"
+	case LeveledCompaction:
+		return "leveled"
+	default:
+		return "unknown"
+	}
+}
+
+// CompactionStrategy decides which level every table lives at and which tables get merged together. The
+// BucketManager owns the tables' files and the manifest, a strategy only arranges the tables it's handed.
+type CompactionStrategy interface {
+	Name() string
+	// addTable places a freshly flushed table and returns the level it was placed at
+	addTable(table *SSTable) int
+	// restoreTable puts a table reopened on startup back at the level the manifest recorded
+	restoreTable(table *SSTable, level int)
+	// pickCompaction returns the next set of tables worth merging, or nil if there's nothing to do. It runs alongside
+	// the compactions already running, so it can't pick any of their inputs.
+	pickCompaction(running []*compaction) *compaction
+	// finishCompaction swaps the compaction's inputs for its outputs (none if every entry was garbage collected) and
+	// returns the level each output was placed at
+	finishCompaction(c *compaction, outputs []*SSTable) []int
+	// levels returns every table, by level
+	levels() map[int][]*SSTable
+}
+
+// compaction is a set of tables picked by a CompactionStrategy to be merged together
+type compaction struct {
+	inputs         []*SSTable
+	outputLevel    int    // where the merged tables go, if the strategy already knows
+	targetFileSize uint32 // the merged tables are split at about this many bytes
+	// every table outside the inputs that could hold older versions of the inputs' keys, which tombstones have to keep
+	// shadowing. filled in by the BucketManager, since it's the same for every strategy
+	olderTables []*SSTable
+	// tombstones written after this (in unix seconds) are kept no matter what, see StoreOptions.TombstoneGracePeriod
+	tombstoneCutoff uint32
+}
+
+func newCompactionStrategy(opts StoreOptions) CompactionStrategy {
+	if opts.Compaction == LeveledCompaction {
+		return newLeveledCompaction(opts.FlushSizeThreshold, opts.LevelSizeMultiplier, opts.TargetFileSize)
+	}
+	return newSizeTieredCompaction(opts.FlushSizeThreshold, opts.TargetFileSize)
+}
+
+// mergeTables streams the newest version of every key across the compaction's inputs into new tables in directory,
+// cutting a new table once one holds targetFileSize bytes. Tombstones and expired records are garbage collected once
+// it's safe to. Only one block per input is held in memory at a time, plus the output's block being filled, its index
+// and its filter, which take a few bits per key of the output, so memory stays bounded however big the merge is. When
+// there's more than one output, they all share the first one's number as their run.
+// The old tables are left untouched, it's up to the caller to record the swap and delete them. Returns no tables if
+// every entry was garbage collected.
+func mergeTables(c *compaction, directory string, allocateTableNum func() uint32, compression Compression, filterPolicy FilterPolicy) ([]*SSTable, error) {
+	utils.LogGREEN("STARTING COMPACTION WITH LENGTH %d", len(c.inputs))
+
+	// * every output's filter is sized up front, from its share of the input bytes rounded up by a block so the filter
+	// * errs on the big side. no output can hold more than every input entry though
+	var totalEntries uint32
+	var inputBytes uint64
+	for _, table := range c.inputs {
+		totalEntries += table.numEntries
+		inputBytes += uint64(table.sizeInBytes)
+	}
+	expectedKeys := totalEntries
+	if inputBytes > 0 {
+		share := uint64(totalEntries)*(uint64(c.targetFileSize)+uint64(BlockSize))/inputBytes + 1
+		expectedKeys = uint32(min(uint64(totalEntries), share))
+	}
+
+	h := mergeHeap{}
+	for _, table := range c.inputs {
+		it := newCompactionInputIterator(table)
+		it.SeekToFirst()
+		if err := it.Error(); err != nil {
+			return nil, err
+		}
+		if it.Valid() {
+			h = append(h, it)
+		}
+	}
+	heap.Init(&h)
+
+	var outputs []*SSTable
+	var writer *sstableWriter
+	// * on failure, nothing written so far is in the manifest yet, so all of it goes
+	abandon := func(err error) ([]*SSTable, error) {
+		if writer != nil {
+			writer.abandon()
+		}
+		for _, table := range outputs {
+			_ = table.file.Close()
+			_ = os.Remove(table.file.Name())
+		}
+		return nil, err
+	}
+
+	now := uint32(time.Now().Unix())
+	lastKey, first := "", true
+	for h.Len() > 0 {
+		it := h[0]
+		record := *it.Record()
+		it.Next()
+		if err := it.Error(); err != nil {
+			return abandon(err)
+		}
+		if it.Valid() {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+
+		// * versions of a key come out newest first, so every version after the first one is shadowed. dropping those
+		// * before tombstones means an old tombstone can never take a newer write of the same key down with it
+		if !first && record.Key == lastKey {
+			continue
+		}
+		first, lastKey = false, record.Key
+		// * an expired record hides older versions of its key just like a tombstone does, so it's dropped the same way
+		if record.Header.deleted(now) && c.canDropTombstone(&record) {
+			continue
+		}
+
+		if writer == nil {
+			var err error
+			if writer, err = newSSTableWriter(directory, allocateTableNum(), expectedKeys, compression, filterPolicy); err != nil {
+				return abandon(err)
+			}
+		}
+		if err := writer.add(&record); err != nil {
+			return abandon(err)
+		}
+		if writer.size() >= c.targetFileSize {
+			table, err := writer.finish()
+			if err != nil {
+				return abandon(err)
+			}
+			outputs, writer = append(outputs, table), nil
+		}
+	}
+
+	if writer != nil {
+		table, err := writer.finish()
+		if err != nil {
+			return abandon(err)
+		}
+		outputs = append(outputs, table)
+	}
+	if len(outputs) > 1 {
+		for _, table := range outputs {
+			table.run = outputs[0].sstCounter
+		}
+	}
+	utils.LogGREEN("Compaction wrote %d tables", len(outputs))
+	return outputs, nil
+}
+
+// mergeHeap orders the compaction's input iterators by their current record: by key, and versions of the same key
+// from newest to oldest
+type mergeHeap []*sstableIterator
+
+func (h mergeHeap) Len() int {
+	return len(h)
+}
+
+func (h mergeHeap) Less(i, j int) bool {
+	a, b := h[i].Record(), h[j].Record()
+	if a.Key == b.Key {
+		return a.Header.SeqNum > b.Header.SeqNum
+	}
+	return a.Key < b.Key
+}
+
+func (h mergeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *mergeHeap) Push(val interface{}) {
+	*h = append(*h, val.(*sstableIterator))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
+
+// canDropTombstone reports whether a tombstone or expired record (the newest version of its key among the inputs) can
+// be garbage collected: it's past the grace period, and no table outside the compaction may hold an older version of
+// its key that it would otherwise bring back to life
+func (c *compaction) canDropTombstone(tombstone *Record) bool {
+	// * an expired record counts as deleted from the moment it expired, which is always after it was written
+	if max(tombstone.Header.TimeStamp, tombstone.Header.ExpiresAt) > c.tombstoneCutoff {
+		return false
+	}
+	for _, table := range c.olderTables {
+		if table.minSeqNum < tombstone.Header.SeqNum && table.overlaps(tombstone.Key, tombstone.Key) && table.bloomFilter.MightContain(tombstone.Key) {
+			return false
+		}
+	}
+	return true
+}
+
+// busyTables returns the table numbers of every input of the running compactions
+func busyTables(running []*compaction) map[uint32]bool {
+	busy := make(map[uint32]bool)
+	for _, c := range running {
+		for _, table := range c.inputs {
+			busy[table.sstCounter] = true
+		}
+	}
+	return busy
+}
+
+// overlaps reports whether the table holds any key in [minKey, maxKey]
+func (sst *SSTable) overlaps(minKey string, maxKey string) bool {
+	return sst.minKey <= maxKey && sst.maxKey >= minKey
+}
@@ -0,0 +1,260 @@
+package store
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// tableFactory writes the input tables of compaction tests into a temp dir, and numbers both them and the tables the
+// compactions write, so the two never collide
+type tableFactory struct {
+	t            *testing.T
+	dir          string
+	nextTableNum uint32
+}
+
+func newTableFactory(t *testing.T) *tableFactory {
+	return &tableFactory{t: t, dir: t.TempDir()}
+}
+
+// newTable writes entries, sorted by key, into the next table
+func (f *tableFactory) newTable(entries []Record) *SSTable {
+	f.t.Helper()
+	table, err := InitSSTableOnDisk(f.dir, f.allocate(), &entries, NoCompression, nil)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return table
+}
+
+// allocate hands out table numbers, it's passed to mergeTables as its allocateTableNum
+func (f *tableFactory) allocate() uint32 {
+	f.nextTableNum++
+	return f.nextTableNum
+}
+
+func TestMergeTables_StreamsAndSplits(t *testing.T) {
+	tables := newTableFactory(t)
+
+	// * three overlapping tables: every key is written in the first, overwritten by the second, and every tenth one
+	// * deleted by the third
+	var seqNum uint64
+	newRecord := func(key string, val string, tombstone bool) Record {
+		seqNum++
+		header := Header{SeqNum: seqNum, KeySize: uint32(len(key)), ValueSize: uint32(len(val))}
+		if tombstone {
+			header.MarkTombstone()
+		}
+		return Record{Header: header, Key: key, Value: val, RecordSize: headerSize + uint32(len(key)+len(val))}
+	}
+	var runs [3][]Record
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("user%05d", i)
+		runs[0] = append(runs[0], newRecord(key, fmt.Sprintf("old%d", i), false))
+	}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("user%05d", i)
+		runs[1] = append(runs[1], newRecord(key, fmt.Sprintf("new%d", i), false))
+		if i%10 == 0 {
+			runs[2] = append(runs[2], newRecord(key, "", true))
+		}
+	}
+	var inputs []*SSTable
+	for i := range runs {
+		inputs = append(inputs, tables.newTable(runs[i]))
+	}
+
+	c := &compaction{inputs: inputs, targetFileSize: 8 * 1024}
+	outputs, err := mergeTables(c, tables.dir, tables.allocate, NoCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) < 3 {
+		t.Fatalf("expected the output to be split into several tables, got %d", len(outputs))
+	}
+
+	count := 0
+	for i, table := range outputs {
+		if i > 0 && outputs[i-1].maxKey >= table.minKey {
+			t.Fatalf("table %d [%s, %s] overlaps the one before it [%s, %s]", i, table.minKey, table.maxKey, outputs[i-1].minKey, outputs[i-1].maxKey)
+		}
+		// * a table is only cut once it reaches the target, so it overshoots by less than a block
+		if i < len(outputs)-1 && (table.sizeInBytes < c.targetFileSize || table.sizeInBytes > c.targetFileSize+uint32(BlockSize)) {
+			t.Fatalf("table %d: expected about %d bytes, got %d", i, c.targetFileSize, table.sizeInBytes)
+		}
+
+		opened, err := OpenSSTable(getNextSstFilename(tables.dir, table.sstCounter))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// * split outputs get filters sized for their share of the input, not for every input entry
+		if opened.bloomFilter.bitSetSize >= 4200*10/4 {
+			t.Fatalf("table %d: expected a filter sized for its share of the keys, got %d bits", i, opened.bloomFilter.bitSetSize)
+		}
+		it := newSSTableIterator(opened)
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			record := it.Record()
+			if !opened.bloomFilter.MightContain(record.Key) {
+				t.Fatalf("table %d: filter rules out %s", i, record.Key)
+			}
+			var n int
+			if _, err := fmt.Sscanf(record.Key, "user%05d", &n); err != nil {
+				t.Fatal(err)
+			}
+			if n%10 == 0 || record.Value != fmt.Sprintf("new%d", n) || record.Header.Tombstone == 1 {
+				t.Fatalf("expected only the newest live versions, got %s = %q", record.Key, record.Value)
+			}
+			count++
+		}
+		if err := it.Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count != 1800 {
+		t.Fatalf("expected 1800 live keys, got %d", count)
+	}
+}
+
+func TestMergeTables_KeepsTombstonesShadowingOlderTables(t *testing.T) {
+	tables := newTableFactory(t)
+	newRecord := func(seqNum uint64, tombstone bool, timestamp uint32) Record {
+		key, val := "user1", "batman"
+		header := Header{SeqNum: seqNum, TimeStamp: timestamp, KeySize: uint32(len(key)), ValueSize: uint32(len(val))}
+		if tombstone {
+			header.MarkTombstone()
+			val, header.ValueSize = "", 0
+		}
+		return Record{Header: header, Key: key, Value: val, RecordSize: headerSize + header.KeySize + header.ValueSize}
+	}
+	older := tables.newTable([]Record{newRecord(1, false, 0)})
+	deleted := tables.newTable([]Record{newRecord(2, true, 100)})
+
+	tests := []struct {
+		name string
+		c    *compaction
+		kept bool
+	}{
+		{"older version outside the compaction", &compaction{inputs: []*SSTable{deleted}, olderTables: []*SSTable{older}, tombstoneCutoff: 200}, true},
+		{"older version within the compaction", &compaction{inputs: []*SSTable{deleted, older}, tombstoneCutoff: 200}, false},
+		{"nothing older anywhere", &compaction{inputs: []*SSTable{deleted}, tombstoneCutoff: 200}, false},
+		{"within the grace period", &compaction{inputs: []*SSTable{deleted}, tombstoneCutoff: 50}, true},
+	}
+	for _, tt := range tests {
+		tt.c.targetFileSize = FlushSizeThreshold
+		outputs, err := mergeTables(tt.c, tables.dir, tables.allocate, NoCompression, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kept := len(outputs) == 1 && outputs[0].numEntries == 1; kept != tt.kept {
+			t.Fatalf("%s: expected tombstone kept = %v, got %d tables", tt.name, tt.kept, len(outputs))
+		}
+		if tt.kept {
+			if record, err := outputs[0].getRecord("user1"); err != nil || record.Header.Tombstone != 1 {
+				t.Fatalf("%s: expected the tombstone to be kept, got %+v (err = %v)", tt.name, record, err)
+			}
+		}
+	}
+}
+
+func TestMergeTables_DropsExpiredRecords(t *testing.T) {
+	tables := newTableFactory(t)
+	newRecord := func(key string, seqNum uint64, expiresAt uint32) Record {
+		val := "batman"
+		header := Header{SeqNum: seqNum, ExpiresAt: expiresAt, KeySize: uint32(len(key)), ValueSize: uint32(len(val))}
+		return Record{Header: header, Key: key, Value: val, RecordSize: headerSize + header.KeySize + header.ValueSize}
+	}
+	// * user1 has a live version in the older table, user2 expired and user3 won't for another hour
+	farFuture := uint32(time.Now().Add(time.Hour).Unix())
+	older := tables.newTable([]Record{newRecord("user1", 1, 0)})
+	newer := tables.newTable([]Record{newRecord("user1", 2, 100), newRecord("user2", 3, 100), newRecord("user3", 4, farFuture)})
+
+	now := uint32(time.Now().Unix())
+	tests := []struct {
+		name string
+		c    *compaction
+		kept []string
+	}{
+		{"older version outside the compaction", &compaction{inputs: []*SSTable{newer}, olderTables: []*SSTable{older}, tombstoneCutoff: now}, []string{"user1", "user3"}},
+		{"older version within the compaction", &compaction{inputs: []*SSTable{newer, older}, tombstoneCutoff: now}, []string{"user3"}},
+		{"within the grace period", &compaction{inputs: []*SSTable{newer}, tombstoneCutoff: 50}, []string{"user1", "user2", "user3"}},
+	}
+	for _, tt := range tests {
+		tt.c.targetFileSize = FlushSizeThreshold
+		outputs, err := mergeTables(tt.c, tables.dir, tables.allocate, NoCompression, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(outputs) != 1 {
+			t.Fatalf("%s: expected 1 table, got %d", tt.name, len(outputs))
+		}
+		var kept []string
+		it := newSSTableIterator(outputs[0])
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			kept = append(kept, it.Record().Key)
+		}
+		if !slices.Equal(kept, tt.kept) {
+			t.Fatalf("%s: expected %v to be kept, got %v", tt.name, tt.kept, kept)
+		}
+	}
+}
+
+func TestSizeTieredCompaction_SplitsMergesIntoARun(t *testing.T) {
+	tables := newTableFactory(t)
+	stc := newSizeTieredCompaction(FlushSizeThreshold, 4*1024)
+
+	// * four similarly sized tables with distinct keys, so merging them is about four times bigger than each of them
+	for i := 0; i < 4; i++ {
+		var entries []Record
+		for j := 0; j < 500; j++ {
+			key, val := fmt.Sprintf("user%d-%03d", i, j), "batman"
+			header := Header{SeqNum: uint64(i*500 + j + 1), KeySize: uint32(len(key)), ValueSize: uint32(len(val))}
+			entries = append(entries, Record{Header: header, Key: key, Value: val, RecordSize: headerSize + header.KeySize + header.ValueSize})
+		}
+		stc.addTable(tables.newTable(entries))
+	}
+
+	c := stc.pickCompaction(nil)
+	if c == nil || len(c.inputs) != 4 {
+		t.Fatalf("expected the 4 tables to be merged, got %+v", c)
+	}
+	outputs, err := mergeTables(c, tables.dir, tables.allocate, NoCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) < 2 {
+		t.Fatalf("expected a merge bigger than the target file size to be split, got %d tables", len(outputs))
+	}
+	for _, table := range outputs {
+		if runID(table) != outputs[0].sstCounter {
+			t.Fatalf("table %d: expected it in run %d, got %d", table.sstCounter, outputs[0].sstCounter, runID(table))
+		}
+	}
+
+	// * the split tables are one run, so they don't make their bucket look like it needs merging again, even once
+	// * they've been reopened from the manifest
+	levels := stc.finishCompaction(c, outputs)
+	if c := stc.pickCompaction(nil); c != nil {
+		t.Fatalf("expected the merged run to be left alone, got a compaction of %d tables", len(c.inputs))
+	}
+	edit := &versionEdit{}
+	for i, table := range outputs {
+		edit.added = append(edit.added, newTableMeta(table, levels[i]))
+	}
+	decoded, err := decodeVersionEdit(edit.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newSizeTieredCompaction(FlushSizeThreshold, 4*1024)
+	for _, meta := range decoded.added {
+		table, err := loadSSTable(tables.dir, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored.restoreTable(table, meta.level)
+	}
+	if c := restored.pickCompaction(nil); c != nil {
+		t.Fatalf("expected the reopened run to be left alone, got a compaction of %d tables", len(c.inputs))
+	}
+}
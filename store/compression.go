@@ -0,0 +1,110 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// Compression is the codec an SSTable's data blocks are compressed with. Every block records its own codec, so a
+// store can switch codecs without rewriting its existing tables.
+type Compression uint8
+
+const (
+	NoCompression Compression = iota
+	FlateCompression
+	ZlibCompression
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case FlateCompression:
+		return "flate"
+	case ZlibCompression:
+		return "zlib"
+	default:
+		return "unknown"
+	}
+}
+
+// blockCompressor compresses the blocks of a single table, reusing its writer across blocks
+type blockCompressor struct {
+	codec       Compression
+	buf         bytes.Buffer
+	flateWriter *flate.Writer
+	zlibWriter  *zlib.Writer
+}
+
+func newBlockCompressor(codec Compression) *blockCompressor {
+	return &blockCompressor{codec: codec}
+}
+
+// compress returns the block as it should be stored and the codec it ended up using. Blocks that don't get any
+// smaller are stored uncompressed.
+func (c *blockCompressor) compress(block []byte) (Compression, []byte, error) {
+	c.buf.Reset()
+
+	var writer io.WriteCloser
+	switch c.codec {
+	case NoCompression:
+		return NoCompression, block, nil
+	case FlateCompression:
+		if c.flateWriter == nil {
+			fw, err := flate.NewWriter(&c.buf, flate.DefaultCompression)
+			if err != nil {
+				return 0, nil, err
+			}
+			c.flateWriter = fw
+		}
+		c.flateWriter.Reset(&c.buf)
+		writer = c.flateWriter
+	case ZlibCompression:
+		if c.zlibWriter == nil {
+			c.zlibWriter = zlib.NewWriter(&c.buf)
+		}
+		c.zlibWriter.Reset(&c.buf)
+		writer = c.zlibWriter
+	default:
+		return 0, nil, fmt.Errorf("unknown compression codec %d", c.codec)
+	}
+
+	if _, err := writer.Write(block); err != nil {
+		return 0, nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return 0, nil, err
+	}
+	if c.buf.Len() >= len(block) {
+		return NoCompression, block, nil
+	}
+	return c.codec, c.buf.Bytes(), nil
+}
+
+// decompressBlock undoes compress for a block stored with codec
+func decompressBlock(codec Compression, data []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	switch codec {
+	case NoCompression:
+		return data, nil
+	case FlateCompression:
+		reader = flate.NewReader(bytes.NewReader(data))
+	case ZlibCompression:
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		reader = zr
+	default:
+		return nil, fmt.Errorf("unknown compression codec %d", codec)
+	}
+
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return decompressed, reader.Close()
+}
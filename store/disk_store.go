@@ -3,7 +3,7 @@ package store
 import (
 	"errors"
 	"fmt"
-	"os"
+	"math"
 	"sync"
 	"time"
 
@@ -13,11 +13,19 @@ import (
 )
 
 type DiskStore struct {
-	mu                 sync.Mutex
-	memtable           *Memtable
-	writeAheadLog      *writeAheadLog
-	bucketManager      *BucketManager
-	immutableMemtables []Memtable
+	mu            sync.Mutex
+	opts          StoreOptions
+	memtable      *Memtable
+	writeAheadLog *writeAheadLog
+	bucketManager *BucketManager
+	// memtables rotated out but not flushed yet, oldest first. they're never written to again, so the flusher can
+	// persist them without holding mu
+	immutableMemtables []*Memtable
+	flushCond          *sync.Cond     // signalled whenever a memtable is queued or flushed, uses mu
+	flusher            sync.WaitGroup // tracks the background flusher
+	closed             bool
+	seqNum             uint64          // last sequence number handed out, every mutation gets the next one
+	snapshots          snapshotTracker // snapshots of open transactions, see transaction.go
 }
 
 type Operation int
@@ -26,162 +34,596 @@ const (
 	PUT Operation = iota
 	GET
 	DELETE
+	BATCH // a WriteBatch, only ever appears in the WAL
 )
 
 const FlushSizeThreshold = 1024 * 1024 * 256
 
 // NewCluster starts up a cluster of N nodes (stores), internally calls the newStore method per node
 func NewCluster(numOfNodes uint32) *Cluster {
-	cluster := Cluster{}
+	return NewClusterWithOptions(numOfNodes, DefaultStoreOptions())
+}
+
+// NewClusterWithOptions starts up a cluster of N nodes, each opened with opts
+func NewClusterWithOptions(numOfNodes uint32, opts StoreOptions) *Cluster {
+	cluster := Cluster{storeOpts: opts}
 	cluster.initNodes(numOfNodes)
 
 	return &cluster
 }
 
 // newStore starts up a single-node KV store
-func newStore(nodeNum uint32) (*DiskStore, error) {
-	ds := &DiskStore{memtable: NewMemtable(), bucketManager: InitBucketManager()}
+func newStore(nodeNum uint32, opts StoreOptions) (*DiskStore, error) {
+	return openStore(fmt.Sprintf("../log/node-%d", nodeNum), fmt.Sprintf("../storage/node-%d", nodeNum), opts)
+}
+
+// openStore starts up a KV store with its WAL segments in logDirectory and its SSTables in storageDirectory.
+// Every table recorded in the manifest is reopened, then whatever the log already holds is replayed on top.
+func openStore(logDirectory string, storageDirectory string, opts StoreOptions) (*DiskStore, error) {
+	ds := &DiskStore{opts: opts, memtable: NewMemtable()}
+	ds.flushCond = sync.NewCond(&ds.mu)
 
-	logFile, err := os.OpenFile(fmt.Sprintf("../log/genesis_wal-%d.log", nodeNum), os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+	manifest, err := openManifest(storageDirectory)
 	if err != nil {
 		return nil, err
 	}
-	ds.writeAheadLog = &writeAheadLog{file: logFile}
+	if err := removeOrphanedTables(storageDirectory, manifest); err != nil {
+		return nil, err
+	}
+	ds.seqNum = manifest.lastSeqNum
+	ds.bucketManager, err = openBucketManager(storageDirectory, manifest, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	wal, err := openWAL(logDirectory, opts)
+	if err != nil {
+		return nil, err
+	}
+	ds.writeAheadLog = wal
+
+	ds.flusher.Add(1)
+	go ds.flushMemtables()
+
+	numRecovered, err := ds.recoverFromWAL()
+	if err != nil {
+		return nil, err
+	}
+	if numRecovered > 0 {
+		utils.Logf("recovered %d operations from WAL", numRecovered)
+	}
+	// * compactions only start once the store is fully built, so none of them race with reading the manifest
+	ds.bucketManager.start()
+
+	return ds, nil
+}
+
+// recoverFromWAL rebuilds the memtable by re-applying every PUT and DELETE in the write-ahead log, in the order
+// they were originally written. Returns the number of operations recovered. Only ever called by openStore, since
+// replaying the log over a live memtable would bring back whatever later writes replaced.
+func (ds *DiskStore) recoverFromWAL() (int, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	var numRecovered int
+	_, err := ds.writeAheadLog.replay(func(op Operation, record *Record) {
+		// GETs are logged too but don't change any state
+		if op == GET {
+			return
+		}
+		ds.memtable.Put(&record.Key, record)
+		ds.seqNum = max(ds.seqNum, record.Header.SeqNum)
+		numRecovered++
+	})
+	if err != nil {
+		return numRecovered, err
+	}
 
-	return ds, err
+	// only flush once everything is replayed, so the rotation seals a segment newer than all the replayed ones
+	return numRecovered, ds.flushIfThresholdReached()
 }
 
+// Put stores the key, value pair and only returns once the write is as durable as the store's WALDurability requires
 func (ds *DiskStore) Put(key *string, value *string) error {
-	// lock access to the store so only 1 goroutine at a time can write to it, preventing race conditions
 	if ds == nil {
 		return fmt.Errorf("disk store is not initialized")
 	}
+
+	lsn, err := ds.put(key, value, 0, nil)
+	if err != nil {
+		return err
+	}
+	// * wait outside the lock so concurrent writers can share a single group commit
+	return ds.writeAheadLog.waitUntilDurable(lsn)
+}
+
+// PutWithTTL stores the key, value pair like Put, but only for ttl. Once it runs out, reads treat the key as deleted
+// and compaction eventually drops it. The expiry has a granularity of one second.
+func (ds *DiskStore) PutWithTTL(key *string, value *string, ttl time.Duration) error {
+	if ds == nil {
+		return fmt.Errorf("disk store is not initialized")
+	}
+	expiresAt, err := expiryFromTTL(ttl)
+	if err != nil {
+		return err
+	}
+
+	lsn, err := ds.put(key, value, expiresAt, nil)
+	if err != nil {
+		return err
+	}
+	return ds.writeAheadLog.waitUntilDurable(lsn)
+}
+
+// CompareAndSwap stores newValue under key, but only if the key's current version is still expectedVersion (as
+// returned by GetWithVersion), otherwise it returns utils.ErrConditionFailed and leaves the key alone. An
+// expectedVersion of 0 expects the key to be missing.
+func (ds *DiskStore) CompareAndSwap(key string, expectedVersion uint64, newValue string) error {
+	if ds == nil {
+		return fmt.Errorf("disk store is not initialized")
+	}
+
+	lsn, err := ds.put(&key, &newValue, 0, func(version uint64) error {
+		if version != expectedVersion {
+			return fmt.Errorf("%w: %s is at version %d, expected %d", utils.ErrConditionFailed, key, version, expectedVersion)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return ds.writeAheadLog.waitUntilDurable(lsn)
+}
+
+// PutIfAbsent stores the key, value pair only if the key is missing (or deleted or expired), otherwise it returns
+// utils.ErrDuplicateKey
+func (ds *DiskStore) PutIfAbsent(key string, value string) error {
+	if ds == nil {
+		return fmt.Errorf("disk store is not initialized")
+	}
+
+	lsn, err := ds.put(&key, &value, 0, func(version uint64) error {
+		if version != 0 {
+			return fmt.Errorf("%w: %s", utils.ErrDuplicateKey, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return ds.writeAheadLog.waitUntilDurable(lsn)
+}
+
+// expiryFromTTL returns the unix second a write with the given TTL expires at, rounded up so it never expires early.
+// Expiries are stored in 32 bits, so TTLs running past early 2106 are rejected rather than wrapped around.
+func expiryFromTTL(ttl time.Duration) (uint32, error) {
+	if ttl <= 0 {
+		return 0, fmt.Errorf("%w: %s", utils.ErrInvalidTTL, ttl)
+	}
+	expiresAt := time.Now().Add(ttl)
+	if expiresAt.Truncate(time.Second) != expiresAt {
+		expiresAt = expiresAt.Truncate(time.Second).Add(time.Second)
+	}
+	if expiresAt.Unix() > math.MaxUint32 {
+		return 0, fmt.Errorf("%w: %s expires past the latest supported expiry", utils.ErrInvalidTTL, ttl)
+	}
+	return uint32(expiresAt.Unix()), nil
+}
+
+// put applies the write to the WAL and memtable and returns the WAL LSN to wait on. expiresAt is 0 for a write that
+// never expires. A conditional write passes condition, which gets the version of the key it would replace and can
+// veto the write by returning an error.
+func (ds *DiskStore) put(key *string, value *string, expiresAt uint32, condition func(version uint64) error) (uint64, error) {
+	// lock access to the store so only 1 goroutine at a time can write to it, preventing race conditions
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
 
+	if ds.closed {
+		return 0, utils.ErrStoreClosed
+	}
 	if ds.memtable == nil {
-		return fmt.Errorf("memtable is not initialized")
+		return 0, fmt.Errorf("memtable is not initialized")
 	}
 
 	err := utils.ValidateKV(key, value)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	// * checked under the same lock as the write, so nothing can sneak in between
+	if condition != nil {
+		version, err := ds.currentVersion(*key)
+		if err != nil {
+			return 0, err
+		}
+		if err := condition(version); err != nil {
+			return 0, err
+		}
 	}
 
 	// append key, value entry to disk
+	record, err := ds.newRecord(PUT, *key, *value, expiresAt)
+	if err != nil {
+		return 0, err
+	}
+
+	lsn, err := ds.writeAheadLog.appendWALOperation(PUT, record)
+	if err != nil {
+		return 0, err
+	}
+	ds.memtable.Put(key, record)
+
+	return lsn, ds.flushIfThresholdReached()
+}
+
+// newRecord stamps a PUT or DELETE of key with the next sequence number, and holds on to the version it replaces if
+// an open transaction might still read it. Requires mu
+func (ds *DiskStore) newRecord(op Operation, key string, value string, expiresAt uint32) (*Record, error) {
+	seqNum := ds.nextSeqNum()
+	if err := ds.preserveReplacedVersion(key, seqNum); err != nil {
+		return nil, err
+	}
 	header := Header{
-		CheckSum:  0,
-		Tombstone: 0,
+		SeqNum:    seqNum,
 		TimeStamp: uint32(time.Now().Unix()),
-		KeySize:   uint32(len(*key)),
-		ValueSize: uint32(len(*value)),
+		ExpiresAt: expiresAt,
+		KeySize:   uint32(len(key)),
+		ValueSize: uint32(len(value)),
+	}
+	if op == DELETE {
+		header.MarkTombstone()
 	}
 	record := &Record{
 		Header:     header,
-		Key:        *key,
-		Value:      *value,
+		Key:        key,
+		Value:      value,
 		RecordSize: headerSize + header.KeySize + header.ValueSize,
 	}
+
+	var err error
 	record.Header.CheckSum, err = record.CalculateChecksum()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return record, nil
+}
+
+// nextSeqNum hands out the sequence number for a new mutation, the caller must hold mu
+func (ds *DiskStore) nextSeqNum() uint64 {
+	ds.seqNum++
+	return ds.seqNum
+}
+
+// flushIfThresholdReached automatically flushes when memtable reaches certain threshold
+func (ds *DiskStore) flushIfThresholdReached() error {
+	if ds.memtable.sizeInBytes >= ds.opts.FlushSizeThreshold {
+		return ds.rotateMemtable()
 	}
+	return nil
+}
 
-	ds.memtable.Put(key, record)
-	err = ds.writeAheadLog.appendWALOperation(PUT, record)
+// rotateMemtable queues up the current memtable for the background flusher and starts a new WAL segment for the fresh
+// one, so writes carry on right away. If the flusher is already MaxImmutableMemtables behind, it waits for it to catch
+// up first. Requires mu
+func (ds *DiskStore) rotateMemtable() error {
+	for len(ds.immutableMemtables) >= max(1, ds.opts.MaxImmutableMemtables) && !ds.closed {
+		ds.flushCond.Wait()
+	}
+
+	sealedSegment, err := ds.writeAheadLog.rotate()
 	if err != nil {
 		return err
 	}
 
-	// * Automatically flush when memtable reaches certain threshold
-	if ds.memtable.sizeInBytes >= FlushSizeThreshold {
-		ds.immutableMemtables = append(ds.immutableMemtables, *deepCopyMemtable(ds.memtable))
-		ds.memtable.clear()
-		ds.FlushMemtable()
+	immutable := ds.memtable
+	immutable.walSegment = sealedSegment
+	ds.immutableMemtables = append(ds.immutableMemtables, immutable)
+	ds.memtable = NewMemtable()
+	ds.flushCond.Broadcast()
+
+	return nil
+}
+
+// flushMemtables runs in the background for as long as the store is open, persisting the queued memtables one at a
+// time, oldest first. Once the store is closed, it drains whatever is still queued before returning.
+func (ds *DiskStore) flushMemtables() {
+	defer ds.flusher.Done()
+
+	for {
+		ds.mu.Lock()
+		for len(ds.immutableMemtables) == 0 && !ds.closed {
+			ds.flushCond.Wait()
+		}
+		if len(ds.immutableMemtables) == 0 {
+			ds.mu.Unlock()
+			return
+		}
+		memtable := ds.immutableMemtables[0]
+		ds.mu.Unlock()
+
+		if err := ds.flushMemtable(memtable); err != nil {
+			// * the memtable stays queued (and its WAL segments on disk), so nothing is lost. if the store is closing,
+			// * replaying the WAL on the next startup brings it back
+			utils.LogRED("failed to flush memtable: %s", err.Error())
+			if ds.isClosed() {
+				return
+			}
+			time.Sleep(flushRetryInterval)
+			continue
+		}
+
+		// * only dropped from the queue once its table is in place, so reads always find its records in one of the two
+		ds.mu.Lock()
+		ds.immutableMemtables = ds.immutableMemtables[1:]
+		ds.flushCond.Broadcast()
+		ds.mu.Unlock()
 	}
+}
 
+const flushRetryInterval = time.Second
+
+// flushMemtable writes the memtable to a new SSTable, hands it to the bucket manager and then releases the WAL
+// segments it came from, which the table (synced and recorded in the manifest by then) makes redundant
+func (ds *DiskStore) flushMemtable(memtable *Memtable) error {
+	sstable, err := memtable.Flush(ds.bucketManager.directory, ds.bucketManager.allocateTableNum(), ds.opts.Compression, ds.opts.FilterPolicy)
+	if err != nil {
+		return err
+	}
+	if err := ds.bucketManager.InsertTable(sstable); err != nil {
+		return err
+	}
+	if err := ds.writeAheadLog.releaseSegments(memtable.walSegment); err != nil {
+		// * the segments are replayed on startup then, which is harmless since their records are all in the table
+		utils.LogRED("failed to release WAL segments: %s", err.Error())
+	}
 	return nil
 }
 
+func (ds *DiskStore) isClosed() bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.closed
+}
+
 func (ds *DiskStore) PutRecordFromGRPC(record *proto.Record) {
+	ds.mu.Lock()
+	if ds.closed {
+		ds.mu.Unlock()
+		utils.LogRED("failed to store migrated record %s: %s", record.Key, utils.ErrStoreClosed.Error())
+		return
+	}
 	rec := convertProtoRecordToStoreRecord(record)
+	// * sequence numbers are per store, so the record is re-stamped as this store's newest write. otherwise its
+	// * sequence number from the old node could shadow (or be shadowed by) writes made here
+	rec.Header.SeqNum = ds.nextSeqNum()
+	rec.Header.CheckSum, _ = rec.CalculateChecksum()
+	if err := ds.preserveReplacedVersion(rec.Key, rec.Header.SeqNum); err != nil {
+		ds.mu.Unlock()
+		utils.LogRED("failed to store migrated record %s: %s", rec.Key, err.Error())
+		return
+	}
+	// migrated records need to survive a crash just like regular writes
+	op := PUT
+	if rec.Header.Tombstone == 1 {
+		op = DELETE
+	}
+	lsn, err := ds.writeAheadLog.appendWALOperation(op, rec)
 	ds.memtable.Put(&record.Key, rec)
+	ds.mu.Unlock()
+
+	if err == nil {
+		err = ds.writeAheadLog.waitUntilDurable(lsn)
+	}
+	if err != nil {
+		utils.LogRED("failed to log migrated record %s: %s", rec.Key, err.Error())
+	}
 	fmt.Printf("stored proto record with key = %s into memtable", rec.Key)
 }
 
 func (ds *DiskStore) Get(key string) (string, error) {
+	value, _, err := ds.GetWithVersion(key)
+	return value, err
+}
+
+// GetWithVersion returns the value of key along with its version, which CompareAndSwap can later check it against
+func (ds *DiskStore) GetWithVersion(key string) (string, uint64, error) {
 	if ds == nil {
-		return "<!>", fmt.Errorf("disk store is not initialized")
+		return "<!>", 0, fmt.Errorf("disk store is not initialized")
 	}
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
 
+	if ds.closed {
+		return "", 0, utils.ErrStoreClosed
+	}
 	//log the get operation first
-	err := ds.writeAheadLog.appendWALOperation(GET, &Record{Key: key})
+	getRecord := &Record{Header: Header{KeySize: uint32(len(key))}, Key: key, RecordSize: headerSize + uint32(len(key))}
+	_, err := ds.writeAheadLog.appendWALOperation(GET, getRecord)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 
-	// * Search memtable first, if not there -> search SSTables on disk
-	record, err := ds.memtable.Get(&key)
-	if err == nil {
-		return record.Value, nil
-	} else if !errors.Is(err, utils.ErrKeyNotFound) {
-		return "<!>", err
-	} // else err is KeyNotFound
+	record, err := ds.newestRecord(key)
+	if err != nil {
+		return "<!>", 0, err
+	}
+	if record == nil || record.Header.deleted(uint32(time.Now().Unix())) {
+		return "", 0, utils.ErrKeyNotFound
+	}
+	return record.Value, record.Header.SeqNum, nil
+}
+
+// newestRecord returns the newest version of key (tombstones included), or nil if the store has never seen it.
+// Requires mu
+func (ds *DiskStore) newestRecord(key string) (*Record, error) {
+	// * Search memtable first, then the memtables still waiting to be flushed (newest first),
+	// * and if it's in none of them -> search SSTables on disk
+	memtables := []*Memtable{ds.memtable}
+	for i := len(ds.immutableMemtables) - 1; i >= 0; i-- {
+		memtables = append(memtables, ds.immutableMemtables[i])
+	}
+	for _, memtable := range memtables {
+		record, err := memtable.Get(&key)
+		if err == nil {
+			return &record, nil
+		} else if !errors.Is(err, utils.ErrKeyNotFound) {
+			return nil, err
+		} // else err is KeyNotFound
+	}
 
-	// * key not found in memtable, thus search SSTables on disk
-	return ds.bucketManager.RetrieveKey(&key)
+	// * key not found in any memtable, thus search SSTables on disk
+	return ds.bucketManager.newestRecord(key)
 }
 
-func (ds *DiskStore) Delete(key string) error {
+// currentVersion returns the version of key's live value, 0 if it's missing, deleted or expired. Requires mu
+func (ds *DiskStore) currentVersion(key string) (uint64, error) {
+	record, err := ds.newestRecord(key)
+	if err != nil || record == nil || record.Header.deleted(uint32(time.Now().Unix())) {
+		return 0, err
+	}
+	return record.Header.SeqNum, nil
+}
+
+// Scan returns an iterator over every live key in [start, end), positioned at the first one. An empty end means no
+// upper bound and a limit <= 0 means no limit. Where several memtables or tables hold the same key, the newest version
+// wins. The iterator has to be closed once it's no longer needed.
+func (ds *DiskStore) Scan(start string, end string, limit int) (*Iterator, error) {
 	if ds == nil {
-		return fmt.Errorf("disk store is not initialized")
+		return nil, fmt.Errorf("disk store is not initialized")
+	}
+	it, err := ds.newIterator(start, end, limit, "")
+	if err != nil {
+		return nil, err
 	}
+	it.SeekToFirst()
+	return it, nil
+}
+
+// NewIterator returns an unpositioned iterator over the whole store, call one of its Seek methods before using it and
+// Close once done
+func (ds *DiskStore) NewIterator() (*Iterator, error) {
+	if ds == nil {
+		return nil, fmt.Errorf("disk store is not initialized")
+	}
+	return ds.newIterator("", "", 0, "")
+}
+
+// newIterator merges every source that might hold a key in [start, end). If prefix isn't empty, tables whose filter
+// rules out any key starting with it are skipped.
+func (ds *DiskStore) newIterator(start string, end string, limit int, prefix string) (*Iterator, error) {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
 
-	// * this is really just appending a new entry but with a tombstone value and empty key
-	value := ""
-	header := Header{
-		TimeStamp: uint32(time.Now().Unix()),
-		KeySize:   uint32(len(key)),
-		ValueSize: uint32(len(value)),
+	if ds.closed {
+		return nil, utils.ErrStoreClosed
 	}
-	header.MarkTombstone()
 
-	deletionRecord := Record{
-		Header:     header,
-		Key:        key,
-		Value:      value,
-		RecordSize: headerSize + header.KeySize + header.ValueSize,
+	// * every source that might hold a key in range, the merge picks each key's winner by sequence number
+	children := []internalIterator{newMemtableIterator(ds.memtable, start, end)}
+	for i := len(ds.immutableMemtables) - 1; i >= 0; i-- {
+		children = append(children, newMemtableIterator(ds.immutableMemtables[i], start, end))
+	}
+	// * the iterator holds on to the tables it reads until it's closed, the rest are released right away
+	var tables []*SSTable
+	for _, table := range ds.bucketManager.tablesNewestFirst() {
+		if table.maxKey < start || (end != "" && table.minKey >= end) ||
+			(prefix != "" && !table.bloomFilter.MightContainPrefix(prefix)) {
+			table.unref()
+			continue
+		}
+		// * copy the table so a compaction reshuffling the buckets doesn't affect the iterator
+		snapshot := *table
+		tables = append(tables, &snapshot)
+		children = append(children, newSSTableIterator(&snapshot))
+	}
+
+	return newIterator(newMergingIterator(children), tables, start, end, limit), nil
+}
+
+// ScanPrefix returns an iterator over every live key starting with prefix, in ascending order. The iterator has to be
+// closed once it's no longer needed.
+func (ds *DiskStore) ScanPrefix(prefix string) (*Iterator, error) {
+	if ds == nil {
+		return nil, fmt.Errorf("disk store is not initialized")
 	}
-	_, err := deletionRecord.CalculateChecksum()
+	it, err := ds.newIterator(prefix, prefixSuccessor(prefix), 0, prefix)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	it.SeekToFirst()
+	return it, nil
+}
+
+// Delete marks the key as deleted and only returns once the tombstone is as durable as the store's WALDurability requires
+func (ds *DiskStore) Delete(key string) error {
+	if ds == nil {
+		return fmt.Errorf("disk store is not initialized")
 	}
 
-	ds.memtable.Put(&key, &deletionRecord)
-	err = ds.writeAheadLog.appendWALOperation(DELETE, &deletionRecord)
+	lsn, err := ds.delete(key)
 	if err != nil {
 		return err
 	}
+	return ds.writeAheadLog.waitUntilDurable(lsn)
+}
 
-	return nil
+func (ds *DiskStore) delete(key string) (uint64, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.closed {
+		return 0, utils.ErrStoreClosed
+	}
+
+	// * this is really just appending a new entry but with a tombstone value and empty key
+	deletionRecord, err := ds.newRecord(DELETE, key, "", 0)
+	if err != nil {
+		return 0, err
+	}
+
+	lsn, err := ds.writeAheadLog.appendWALOperation(DELETE, deletionRecord)
+	if err != nil {
+		return 0, err
+	}
+	ds.memtable.Put(&key, deletionRecord)
+
+	return lsn, ds.flushIfThresholdReached()
+}
+
+// BlockCacheStats returns the hit and miss counters of the store's block cache, all zeroes if it's disabled
+func (ds *DiskStore) BlockCacheStats() BlockCacheStats {
+	if ds.bucketManager.blockCache == nil {
+		return BlockCacheStats{}
+	}
+	return ds.bucketManager.blockCache.Stats()
 }
 
 func (ds *DiskStore) LengthOfMemtable() {
 	fmt.Println(len(ds.memtable.data.Keys()))
 }
 
-func (ds *DiskStore) FlushMemtable() {
-	for i := range ds.immutableMemtables {
-		sstable := ds.immutableMemtables[i].Flush("storage")
-		err := ds.bucketManager.InsertTable(sstable)
-		if err != nil {
-			return
+// FlushMemtable rotates out the current memtable (if it holds anything) and waits until it and every memtable queued
+// before it are flushed to disk
+func (ds *DiskStore) FlushMemtable() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.closed {
+		return utils.ErrStoreClosed
+	}
+
+	if ds.memtable.data.Size() > 0 {
+		if err := ds.rotateMemtable(); err != nil {
+			return err
 		}
-		ds.immutableMemtables = ds.immutableMemtables[:i] // basically removing a "queued" memtable since its flushed
+	}
+	ds.waitForFlushes()
+	return nil
+}
+
+// waitForFlushes blocks until the flusher has emptied the queue. Requires mu
+func (ds *DiskStore) waitForFlushes() {
+	for len(ds.immutableMemtables) > 0 && !ds.closed {
+		ds.flushCond.Wait()
 	}
 }
 
@@ -190,22 +632,31 @@ func (ds *DiskStore) DebugMemtable() {
 	utils.Logf("CURRENT SIZE IN BYTES: %d", ds.memtable.sizeInBytes)
 }
 
-func deepCopyMemtable(memtable *Memtable) *Memtable {
-	deepCopy := NewMemtable()
-	deepCopy.sizeInBytes = memtable.sizeInBytes
-
-	// copy the tree data
-	keys := memtable.data.Keys()
-	values := memtable.data.Values()
-
-	for i := range keys {
-		deepCopy.data.Put(keys[i], values[i])
+// Close waits for the memtables queued up for flushing to hit disk, flushes any WAL operations that haven't yet, waits
+// for running compactions and closes the log and manifest. Any call on the store after that fails with
+// utils.ErrStoreClosed.
+func (ds *DiskStore) Close() bool {
+	ds.mu.Lock()
+	if ds.closed {
+		ds.mu.Unlock()
+		return true
 	}
+	ds.closed = true
+	ds.flushCond.Broadcast()
+	ds.mu.Unlock()
+	// * the flusher drains the queue before it returns
+	ds.flusher.Wait()
 
-	return deepCopy
-}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
 
-func (ds *DiskStore) Close() bool {
-	//TODO implement me
+	if err := ds.writeAheadLog.close(); err != nil {
+		utils.LogRED("failed to close WAL: %s", err.Error())
+		return false
+	}
+	if err := ds.bucketManager.close(); err != nil {
+		utils.LogRED("failed to close manifest: %s", err.Error())
+		return false
+	}
 	return true
 }
@@ -1,15 +1,218 @@
 package store
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"math/rand"
+	"os"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/tferdous17/genesis/utils"
 )
 
+func TestDiskStore_GetNewestAcrossTables(t *testing.T) {
+	opts := DefaultStoreOptions()
+	opts.FlushSizeThreshold = 3072
+	store, err := openStore(t.TempDir(), t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// * overwrite every key a few times so older versions end up spread across several tables
+	expected := make(map[string]string)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			key, val := fmt.Sprintf("user%03d", i), fmt.Sprintf("hero%d-%d", i, round)
+			if err := store.Put(&key, &val); err != nil {
+				t.Fatal(err)
+			}
+			expected[key] = val
+		}
+	}
+	for i := 0; i < 100; i += 10 {
+		key := fmt.Sprintf("user%03d", i)
+		if err := store.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		delete(expected, key)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("user%03d", i)
+		val, err := store.Get(key)
+		if want, ok := expected[key]; ok {
+			if err != nil || val != want {
+				t.Fatalf("expected %s = %s, got %q (err = %v)", key, want, val, err)
+			}
+		} else if !errors.Is(err, utils.ErrKeyNotFound) {
+			t.Fatalf("expected %s to be deleted, got %q (err = %v)", key, val, err)
+		}
+	}
+}
+
+func TestDiskStore_CompactionKeepsNewestVersion(t *testing.T) {
+	logDir, storageDir := t.TempDir(), t.TempDir()
+	opts := DefaultStoreOptions()
+	opts.FlushSizeThreshold = 512
+	store, err := openStore(logDir, storageDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// * every round lands within the same second, so only sequence numbers can tell the versions apart
+	expected := make(map[string]string)
+	for round := 0; round < 6; round++ {
+		for i := 0; i < 50; i++ {
+			key, val := fmt.Sprintf("user%03d", i), fmt.Sprintf("hero%d-%d", i, round)
+			if round == 3 && i%5 == 0 {
+				// * a tombstone followed by newer writes must not take those writes down with it
+				if err := store.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			if err := store.Put(&key, &val); err != nil {
+				t.Fatal(err)
+			}
+			expected[key] = val
+		}
+	}
+
+	for key, want := range expected {
+		if val, err := store.Get(key); err != nil || val != want {
+			t.Fatalf("expected %s = %s, got %q (err = %v)", key, want, val, err)
+		}
+	}
+
+	lastSeqNum := store.seqNum
+	if !store.Close() {
+		t.Fatal("failed to close store")
+	}
+	reopened, err := openStore(logDir, storageDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.seqNum != lastSeqNum {
+		t.Fatalf("expected sequence numbers to resume from %d, got %d", lastSeqNum, reopened.seqNum)
+	}
+}
+
+func TestDiskStore_Scan(t *testing.T) {
+	opts := DefaultStoreOptions()
+	opts.FlushSizeThreshold = 3072
+	store, err := openStore(t.TempDir(), t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// * spread keys and their overwrites across several tables and the memtable
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 100; i++ {
+			key, val := fmt.Sprintf("user%03d", i), fmt.Sprintf("hero%d-%d", i, round)
+			if err := store.Put(&key, &val); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, key := range []string{"user010", "user015"} {
+		if err := store.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	collect := func(it *Iterator, err error) []string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		var pairs []string
+		for ; it.Valid(); it.Next() {
+			pairs = append(pairs, it.Key()+"="+it.Value())
+		}
+		if err := it.Error(); err != nil {
+			t.Fatal(err)
+		}
+		return pairs
+	}
+
+	got := collect(store.Scan("user009", "user017", 0))
+	want := []string{"user009=hero9-1", "user011=hero11-1", "user012=hero12-1", "user013=hero13-1", "user014=hero14-1", "user016=hero16-1"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	if got := collect(store.Scan("user009", "", 3)); len(got) != 3 || got[2] != "user012=hero12-1" {
+		t.Fatalf("expected 3 pairs ending at user012, got %v", got)
+	}
+
+	if got := collect(store.ScanPrefix("user09")); len(got) != 10 || got[0] != "user090=hero90-1" || got[9] != "user099=hero99-1" {
+		t.Fatalf("expected user090 through user099, got %v", got)
+	}
+}
+
+func TestDiskStore_IteratorSeekAndPrev(t *testing.T) {
+	opts := DefaultStoreOptions()
+	opts.FlushSizeThreshold = 3072
+	store, err := openStore(t.TempDir(), t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 100; i += 2 {
+			key, val := fmt.Sprintf("user%03d", i), fmt.Sprintf("hero%d-%d", i, round)
+			if err := store.Put(&key, &val); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := store.Delete("user050"); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := store.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	// * the latest 3 keys before user053, skipping the deleted user050
+	var keys []string
+	for it.SeekForPrev("user053"); it.Valid() && len(keys) < 3; it.Prev() {
+		keys = append(keys, it.Key())
+	}
+	if fmt.Sprint(keys) != "[user052 user048 user046]" {
+		t.Fatalf("expected [user052 user048 user046], got %v", keys)
+	}
+
+	// * switching direction mid-iteration
+	it.Seek("user047")
+	it.Next()
+	it.Prev()
+	if !it.Valid() || it.Key() != "user048" || it.Value() != "hero48-1" {
+		t.Fatalf("expected user048 = hero48-1 after Next then Prev")
+	}
+
+	it.SeekToLast()
+	if !it.Valid() || it.Key() != "user098" {
+		t.Fatalf("expected the last key to be user098")
+	}
+	it.SeekForPrev("user")
+	if it.Valid() {
+		t.Fatalf("expected nothing before the first key, got %s", it.Key())
+	}
+	if err := it.Error(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 //var epoch = 1_000
 
 func BenchmarkDiskStore_Put(b *testing.B) {
-	store, _ := newStore(1)
+	store, _ := newStore(1, asyncStoreOptions())
 	val := "val"
 	for i := 0; i < b.N; i++ {
 		key := generateRandomKey()
@@ -24,7 +227,7 @@ func BenchmarkDiskStore_Put(b *testing.B) {
 }
 
 func BenchmarkDiskStore_Get(b *testing.B) {
-	store, _ := newStore(1)
+	store, _ := newStore(1, asyncStoreOptions())
 	testK := "Foxtrot"
 	val := "val"
 	for i := 0; i < 1_000_000; i++ {
@@ -70,3 +273,468 @@ func generateRandomString(length int) string {
 	}
 	return string(b)
 }
+
+// asyncStoreOptions keeps fsync latency out of the benchmarks (so they measure the store itself) and out of tests that
+// don't care about durability
+func asyncStoreOptions() StoreOptions {
+	opts := DefaultStoreOptions()
+	opts.Durability = Async
+	return opts
+}
+
+func TestDiskStore_ReadsDuringBackgroundCompaction(t *testing.T) {
+	opts := asyncStoreOptions()
+	opts.FlushSizeThreshold = 512
+	opts.MaxBackgroundCompactions = 2
+	store, err := openStore(t.TempDir(), t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, val := "user000", "hero0"
+	if err := store.Put(&key, &val); err != nil {
+		t.Fatal(err)
+	}
+
+	// * keep reading the first key while later writes flush and compact the table it lives in
+	done := make(chan struct{})
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(readErr)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if val, err := store.Get("user000"); err != nil || val != "hero0" {
+				readErr <- fmt.Errorf("expected user000 = hero0, got %q (err = %v)", val, err)
+				return
+			}
+		}
+	}()
+
+	for i := 1; i < 2000; i++ {
+		key, val := fmt.Sprintf("villain%03d", i%300), fmt.Sprintf("hero%d", i)
+		if err := store.Put(&key, &val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	if err := <-readErr; err != nil {
+		t.Fatal(err)
+	}
+
+	// * drain the flush queue first, a flush scheduling a compaction mid-wait would race with it
+	if err := store.FlushMemtable(); err != nil {
+		t.Fatal(err)
+	}
+	store.bucketManager.waitForCompactions()
+	for i := 1700; i < 2000; i++ {
+		key := fmt.Sprintf("villain%03d", i%300)
+		if val, err := store.Get(key); err != nil || val != fmt.Sprintf("hero%d", i) {
+			t.Fatalf("expected %s = hero%d, got %q (err = %v)", key, i, val, err)
+		}
+	}
+}
+
+func TestDiskStore_DeletedKeyStaysDeletedAcrossBuckets(t *testing.T) {
+	store, err := openStore(t.TempDir(), t.TempDir(), asyncStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	flush := func(prefix string, n int) {
+		for i := 0; i < n; i++ {
+			key, val := fmt.Sprintf("%s%03d", prefix, i), fmt.Sprintf("hero%d", i)
+			if err := store.Put(&key, &val); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.FlushMemtable(); err != nil {
+			t.Fatal(err)
+		}
+		store.bucketManager.waitForCompactions()
+	}
+
+	// * four flushes compact into one bigger table holding user0-000, which moves up a bucket
+	for i := 0; i < 4; i++ {
+		flush(fmt.Sprintf("user%d-", i), 100)
+	}
+	// * then four small flushes, one of them deleting user0-000, compact in the bottom bucket without that bigger table
+	if err := store.Delete("user0-000"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		flush(fmt.Sprintf("hero%d-", i), 3)
+	}
+
+	if tables := store.bucketManager.strategy.levels(); len(tables[2]) != 1 || len(tables[1]) != 1 {
+		t.Fatalf("expected one compacted table in each of the first two buckets, got %d and %d", len(tables[1]), len(tables[2]))
+	}
+	if val, err := store.Get("user0-000"); !errors.Is(err, utils.ErrKeyNotFound) {
+		t.Fatalf("expected user0-000 to stay deleted, got %q (err = %v)", val, err)
+	}
+}
+
+func TestDiskStore_ReadsFromMemtablesWaitingToFlush(t *testing.T) {
+	logDir := t.TempDir()
+	store, err := openStore(logDir, t.TempDir(), asyncStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(key string, val string) {
+		if err := store.Put(&key, &val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// * holding the bucket manager's lock stalls the flusher right before it inserts the table, so both rotated out
+	// * memtables stay queued
+	store.bucketManager.mu.Lock()
+	put("user000", "hero0")
+	put("user001", "hero1")
+	store.mu.Lock()
+	err = store.rotateMemtable()
+	store.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	put("user000", "villain0")
+	store.mu.Lock()
+	err = store.rotateMemtable()
+	queued := len(store.immutableMemtables)
+	store.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	put("user002", "hero2")
+
+	if queued != 2 {
+		t.Fatalf("expected 2 memtables waiting to flush, got %d", queued)
+	}
+	for key, want := range map[string]string{"user000": "villain0", "user001": "hero1", "user002": "hero2"} {
+		if val, err := store.Get(key); err != nil || val != want {
+			t.Fatalf("expected %s = %s, got %q (err = %v)", key, want, val, err)
+		}
+	}
+	segments, err := listWALSegments(logDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 3 {
+		t.Fatalf("expected the WAL to keep all 3 segments until their memtables are flushed, got %d", len(segments))
+	}
+
+	store.bucketManager.mu.Unlock()
+	store.mu.Lock()
+	store.waitForFlushes()
+	store.mu.Unlock()
+
+	if segments, err = listWALSegments(logDir); err != nil || len(segments) != 1 {
+		t.Fatalf("expected only the active WAL segment to be left, got %v (err = %v)", segments, err)
+	}
+	if val, err := store.Get("user000"); err != nil || val != "villain0" {
+		t.Fatalf("expected user000 = villain0, got %q (err = %v)", val, err)
+	}
+	if !store.Close() {
+		t.Fatal("failed to close store")
+	}
+}
+
+func TestDiskStore_DeletesAloneFlushTheMemtable(t *testing.T) {
+	opts := asyncStoreOptions()
+	opts.FlushSizeThreshold = 512
+	store, err := openStore(t.TempDir(), t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// * tombstones take up memtable space too, so a delete-only workload still has to rotate
+	for i := 0; i < 100; i++ {
+		if err := store.Delete(fmt.Sprintf("user%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.mu.Lock()
+	store.waitForFlushes()
+	store.mu.Unlock()
+
+	store.bucketManager.mu.Lock()
+	numTables := 0
+	for _, tables := range store.bucketManager.strategy.levels() {
+		numTables += len(tables)
+	}
+	store.bucketManager.mu.Unlock()
+	if numTables == 0 {
+		t.Fatal("expected the tombstones to be flushed to a table")
+	}
+	if store.memtable.sizeInBytes >= opts.FlushSizeThreshold {
+		t.Fatalf("expected the memtable to be rotated below %d bytes, holds %d", opts.FlushSizeThreshold, store.memtable.sizeInBytes)
+	}
+	if _, err := store.Get("user000"); err == nil {
+		t.Fatal("expected user000 to stay deleted")
+	}
+	if !store.Close() {
+		t.Fatal("failed to close store")
+	}
+}
+
+func TestDiskStore_ExpiredKeysAreHidden(t *testing.T) {
+	store, err := openStore(t.TempDir(), t.TempDir(), asyncStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, val := "user000", "hero0"
+	if err := store.PutWithTTL(&key, &val, 0); !errors.Is(err, utils.ErrInvalidTTL) {
+		t.Fatalf("expected a zero TTL to be rejected, got %v", err)
+	}
+	if err := store.PutWithTTL(&key, &val, math.MaxInt64); !errors.Is(err, utils.ErrInvalidTTL) {
+		t.Fatalf("expected a TTL past the latest storable expiry to be rejected, got %v", err)
+	}
+
+	// * every even key expires right away, the odd ones either never expire or only in an hour
+	for i := 0; i < 10; i++ {
+		key, val := fmt.Sprintf("user%03d", i), fmt.Sprintf("hero%d", i)
+		if i%2 == 0 {
+			_, err = store.put(&key, &val, uint32(time.Now().Unix()), nil)
+		} else if i%3 == 0 {
+			err = store.PutWithTTL(&key, &val, time.Hour)
+		} else {
+			err = store.Put(&key, &val)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(where string) {
+		t.Helper()
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("user%03d", i)
+			val, err := store.Get(key)
+			if i%2 == 0 && !errors.Is(err, utils.ErrKeyNotFound) {
+				t.Fatalf("%s: expected %s to have expired, got %q (err = %v)", where, key, val, err)
+			} else if i%2 == 1 && (err != nil || val != fmt.Sprintf("hero%d", i)) {
+				t.Fatalf("%s: expected %s = hero%d, got %q (err = %v)", where, key, i, val, err)
+			}
+		}
+		it, err := store.Scan("", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for ; it.Valid(); it.Next() {
+			keys = append(keys, it.Key())
+		}
+		it.Close()
+		if len(keys) != 5 || keys[0] != "user001" || keys[4] != "user009" {
+			t.Fatalf("%s: expected only the odd keys, got %v", where, keys)
+		}
+	}
+	check("memtable")
+	if err := store.FlushMemtable(); err != nil {
+		t.Fatal(err)
+	}
+	check("sstable")
+}
+
+func TestDiskStore_TableFilesCloseOnceReleased(t *testing.T) {
+	store, err := openStore(t.TempDir(), t.TempDir(), asyncStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	flush := func(i int) {
+		key, val := fmt.Sprintf("user%d", i), "batman"
+		if err := store.Put(&key, &val); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.FlushMemtable(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// * hold on to the first table like a reader would, then flush enough tables for it to be compacted away
+	flush(0)
+	held := store.bucketManager.tablesNewestFirst()
+	if len(held) != 1 {
+		t.Fatalf("expected a single table, got %d", len(held))
+	}
+	for i := 1; i < 4; i++ {
+		flush(i)
+	}
+	store.bucketManager.waitForCompactions()
+	if _, live := tablesByNum(t, store)[held[0].sstCounter]; live {
+		t.Fatalf("expected table %d to be compacted away", held[0].sstCounter)
+	}
+	if val, err := held[0].Get("user0"); err != nil || val != "batman" {
+		t.Fatalf("expected a held table to stay readable after being swapped out, got %q (err = %v)", val, err)
+	}
+	releaseTables(held)
+	if _, err := held[0].file.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("expected the swapped out table's file to be closed once released, got %v", err)
+	}
+
+	// * closing the store closes every live table, unless an iterator is still reading it
+	it, err := store.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := store.bucketManager.tablesNewestFirst()
+	releaseTables(live)
+	store.Close()
+	it.SeekToFirst()
+	if !it.Valid() || it.Key() != "user0" {
+		t.Fatalf("expected an open iterator to outlive the store, got err = %v", it.Error())
+	}
+	it.Close()
+	for _, table := range live {
+		if _, err := table.file.Stat(); !errors.Is(err, os.ErrClosed) {
+			t.Fatalf("expected table %d to be closed, got %v", table.sstCounter, err)
+		}
+	}
+}
+
+func TestDiskStore_ConditionalWrites(t *testing.T) {
+	store, err := openStore(t.TempDir(), t.TempDir(), asyncStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.PutIfAbsent("user1", "batman"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutIfAbsent("user1", "joker"); !errors.Is(err, utils.ErrDuplicateKey) {
+		t.Fatalf("expected ErrDuplicateKey, got %v", err)
+	}
+	_, version, err := store.GetWithVersion("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CompareAndSwap("user1", version, "robin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CompareAndSwap("user1", version, "joker"); !errors.Is(err, utils.ErrConditionFailed) {
+		t.Fatalf("expected ErrConditionFailed for a stale version, got %v", err)
+	}
+
+	// * versions survive a flush, and a deleted key counts as missing again
+	if err := store.FlushMemtable(); err != nil {
+		t.Fatal(err)
+	}
+	val, version, err := store.GetWithVersion("user1")
+	if err != nil || val != "robin" {
+		t.Fatalf("expected user1 = robin, got %q (err = %v)", val, err)
+	}
+	if err := store.Delete("user1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CompareAndSwap("user1", version, "joker"); !errors.Is(err, utils.ErrConditionFailed) {
+		t.Fatalf("expected ErrConditionFailed for a deleted key, got %v", err)
+	}
+	if err := store.CompareAndSwap("user1", 0, "alfred"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutIfAbsent("user1", "joker"); !errors.Is(err, utils.ErrDuplicateKey) {
+		t.Fatalf("expected ErrDuplicateKey, got %v", err)
+	}
+}
+
+func TestDiskStore_CompareAndSwapLosesNoUpdates(t *testing.T) {
+	store, err := openStore(t.TempDir(), t.TempDir(), asyncStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutIfAbsent("counter", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// * every goroutine keeps retrying its read-modify-write until its swap goes through
+	const workers, increments = 8, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for done := 0; done < increments; {
+				val, version, err := store.GetWithVersion("counter")
+				if err != nil {
+					errs <- err
+					return
+				}
+				n, _ := strconv.Atoi(val)
+				err = store.CompareAndSwap("counter", version, strconv.Itoa(n+1))
+				if errors.Is(err, utils.ErrConditionFailed) {
+					continue
+				} else if err != nil {
+					errs <- err
+					return
+				}
+				done++
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if val, err := store.Get("counter"); err != nil || val != strconv.Itoa(workers*increments) {
+		t.Fatalf("expected counter = %d, got %q (err = %v)", workers*increments, val, err)
+	}
+}
+
+func TestDiskStore_OperationsAfterCloseFail(t *testing.T) {
+	store, err := openStore(t.TempDir(), t.TempDir(), asyncStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, val := "user1", "batman"
+	if err := store.Put(&key, &val); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.FlushMemtable(); err != nil {
+		t.Fatal(err)
+	}
+	tx := beginTransaction(t, store)
+	store.Close()
+
+	if err := store.Put(&key, &val); !errors.Is(err, utils.ErrStoreClosed) {
+		t.Fatalf("expected ErrStoreClosed from Put, got %v", err)
+	}
+	if err := store.Delete(key); !errors.Is(err, utils.ErrStoreClosed) {
+		t.Fatalf("expected ErrStoreClosed from Delete, got %v", err)
+	}
+	batch := NewWriteBatch()
+	batch.Put("user2", "robin")
+	if err := store.Write(batch); !errors.Is(err, utils.ErrStoreClosed) {
+		t.Fatalf("expected ErrStoreClosed from Write, got %v", err)
+	}
+	if _, err := store.Get(key); !errors.Is(err, utils.ErrStoreClosed) {
+		t.Fatalf("expected ErrStoreClosed from Get, got %v", err)
+	}
+
+	if _, err := store.Scan("", "", 0); !errors.Is(err, utils.ErrStoreClosed) {
+		t.Fatalf("expected ErrStoreClosed from Scan, got %v", err)
+	}
+	if _, err := store.ScanPrefix("user"); !errors.Is(err, utils.ErrStoreClosed) {
+		t.Fatalf("expected ErrStoreClosed from ScanPrefix, got %v", err)
+	}
+	if _, err := store.NewIterator(); !errors.Is(err, utils.ErrStoreClosed) {
+		t.Fatalf("expected ErrStoreClosed from NewIterator, got %v", err)
+	}
+	if _, err := tx.Get(key); !errors.Is(err, utils.ErrStoreClosed) {
+		t.Fatalf("expected ErrStoreClosed from Transaction.Get, got %v", err)
+	}
+	tx.Rollback()
+	if _, err := store.Begin(); !errors.Is(err, utils.ErrStoreClosed) {
+		t.Fatalf("expected ErrStoreClosed from Begin, got %v", err)
+	}
+	if len(store.snapshots.open) != 0 {
+		t.Fatalf("expected no snapshots left open, got %v", store.snapshots.open)
+	}
+	// * closing released every table, so none of them can be referenced again
+	if tables := store.bucketManager.tablesNewestFirst(); len(tables) != 0 {
+		t.Fatalf("expected no readable tables once closed, got %d", len(tables))
+	}
+}
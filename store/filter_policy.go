@@ -0,0 +1,55 @@
+package store
+
+import "fmt"
+
+// FilterPolicy decides how the filters of new SSTables are built. Every filter records how it was built, so tables
+// written under one policy stay readable after the store switches to another.
+type FilterPolicy interface {
+	Name() string
+	// NewFilter returns an empty filter sized for numKeys keys
+	NewFilter(numKeys uint32) *BloomFilter
+}
+
+// DefaultFilterPolicy is a whole key bloom filter with a 1% false positive rate
+var DefaultFilterPolicy = NewBloomFilterPolicy(10)
+
+// bloomFilterPolicy builds bloom filters over whole keys (or over their first prefixLen bytes)
+type bloomFilterPolicy struct {
+	bitsPerKey float64
+	scheme     hashScheme
+	prefixLen  uint32
+}
+
+// NewBloomFilterPolicy hashes every key bitsPerKey*ln(2) times with a differently seeded murmur3. 10 bits per key
+// gives about a 1% false positive rate.
+func NewBloomFilterPolicy(bitsPerKey float64) FilterPolicy {
+	return &bloomFilterPolicy{bitsPerKey: bitsPerKey, scheme: murmur3SeededScheme}
+}
+
+// NewDoubleHashingFilterPolicy has the same false positive rate as NewBloomFilterPolicy, but only costs a single
+// murmur3 call per key no matter how many bits per key are used.
+func NewDoubleHashingFilterPolicy(bitsPerKey float64) FilterPolicy {
+	return &bloomFilterPolicy{bitsPerKey: bitsPerKey, scheme: doubleHashingScheme}
+}
+
+// NewPrefixBloomFilterPolicy builds double hashing filters over the first prefixLen bytes of every key instead of the
+// whole key, which lets ScanPrefix skip tables without a single key starting with the prefix. Point lookups still use
+// the filter, but any key sharing the prefix passes it.
+func NewPrefixBloomFilterPolicy(prefixLen uint32, bitsPerKey float64) FilterPolicy {
+	return &bloomFilterPolicy{bitsPerKey: bitsPerKey, scheme: doubleHashingScheme, prefixLen: prefixLen}
+}
+
+func (fp *bloomFilterPolicy) Name() string {
+	scheme := "seeded"
+	if fp.scheme == doubleHashingScheme {
+		scheme = "double-hashing"
+	}
+	if fp.prefixLen > 0 {
+		return fmt.Sprintf("prefix-bloom(%d, %.1f, %s)", fp.prefixLen, fp.bitsPerKey, scheme)
+	}
+	return fmt.Sprintf("bloom(%.1f, %s)", fp.bitsPerKey, scheme)
+}
+
+func (fp *bloomFilterPolicy) NewFilter(numKeys uint32) *BloomFilter {
+	return newSizedBloomFilter(numKeys, fp.bitsPerKey, fp.scheme, fp.prefixLen)
+}
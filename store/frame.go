@@ -0,0 +1,79 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+Append-only logs (the WAL and the MANIFEST) write every entry as a frame:
+
+| Length | LenCRC | CRC | Payload |
+
+Length (4 bytes) counts the payload and LenCRC (4 bytes) covers just the length, so a corrupted length is caught
+before it's used to find the end of the frame. The CRC (4 bytes) covers the length and the entire payload, so a frame
+is only accepted if every byte of it made it to disk intact.
+*/
+const frameHeaderSize = 12
+
+// errTornWrite marks a frame that was only partially written to the end of a log
+var errTornWrite = errors.New("torn write")
+
+func encodeFrame(payload []byte) []byte {
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(frame[:4]))
+	frame = append(frame, payload...)
+	binary.LittleEndian.PutUint32(frame[8:12], frameChecksum(frame))
+
+	return frame
+}
+
+// decodeFrame decodes the frame at the start of buf, which runs to the end of the log, and returns its payload
+// along with the full size of the frame.
+//
+// A partial header, a frame with a valid length that runs past the end of the log, the final frame failing its CRC,
+// or nothing but zeroes left in the log, is what an interrupted write looks like and returns errTornWrite. A length
+// failing its own CRC, or a CRC failure on any other frame, means the log is corrupted. Since the length is checked
+// on its own, a corrupted length can never pass for a frame running off the end of the log and cut off the valid
+// frames after it.
+func decodeFrame(buf []byte) ([]byte, int, error) {
+	if len(buf) < frameHeaderSize || allZeroes(buf) {
+		return nil, 0, errTornWrite
+	}
+	if binary.LittleEndian.Uint32(buf[4:8]) != crc32.ChecksumIEEE(buf[:4]) {
+		return nil, 0, fmt.Errorf("length checksum mismatch")
+	}
+	length := int(binary.LittleEndian.Uint32(buf[:4]))
+	frameSize := frameHeaderSize + length
+	if frameSize > len(buf) {
+		return nil, 0, errTornWrite
+	}
+
+	frame := buf[:frameSize]
+	if binary.LittleEndian.Uint32(frame[8:12]) != frameChecksum(frame) {
+		if frameSize == len(buf) {
+			return nil, 0, errTornWrite
+		}
+		return nil, 0, fmt.Errorf("checksum mismatch")
+	}
+
+	return frame[frameHeaderSize:], frameSize, nil
+}
+
+// frameChecksum computes the CRC over the length prefix and payload, skipping both CRC fields
+func frameChecksum(frame []byte) uint32 {
+	crc := crc32.ChecksumIEEE(frame[:4])
+	return crc32.Update(crc, crc32.IEEETable, frame[frameHeaderSize:])
+}
+
+func allZeroes(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
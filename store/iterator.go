@@ -0,0 +1,422 @@
+package store
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// internalIterator walks the raw records of a single source (a memtable or an SSTable) in key order, tombstones
+// included. Every source holds at most one record per key.
+type internalIterator interface {
+	// Seek positions the iterator at the first record with a key >= key
+	Seek(key string)
+	// SeekForPrev positions the iterator at the last record with a key <= key
+	SeekForPrev(key string)
+	SeekToFirst()
+	SeekToLast()
+	Valid() bool
+	Next()
+	Prev()
+	Record() *Record
+	Error() error
+}
+
+// sliceIterator iterates over records that are already sorted in memory, i.e. a snapshot of part of a memtable
+type sliceIterator struct {
+	records []Record
+	pos     int
+}
+
+// newMemtableIterator snapshots the records of m with a key in [start, end), which is all an Iterator bounded by them
+// can ever reach, so a narrow scan only copies what it needs rather than the whole memtable
+func newMemtableIterator(m *Memtable, start string, end string) *sliceIterator {
+	return &sliceIterator{records: m.recordsInRange(start, end), pos: -1}
+}
+
+func (it *sliceIterator) Seek(key string) {
+	it.pos = sort.Search(len(it.records), func(i int) bool { return it.records[i].Key >= key })
+}
+
+func (it *sliceIterator) SeekForPrev(key string) {
+	it.pos = sort.Search(len(it.records), func(i int) bool { return it.records[i].Key > key }) - 1
+}
+
+func (it *sliceIterator) SeekToFirst()    { it.pos = 0 }
+func (it *sliceIterator) SeekToLast()     { it.pos = len(it.records) - 1 }
+func (it *sliceIterator) Valid() bool     { return it.pos >= 0 && it.pos < len(it.records) }
+func (it *sliceIterator) Next()           { it.pos++ }
+func (it *sliceIterator) Prev()           { it.pos-- }
+func (it *sliceIterator) Record() *Record { return &it.records[it.pos] }
+func (it *sliceIterator) Error() error    { return nil }
+
+// sstableIterator walks an SSTable one data block at a time, decoding a whole block whenever it moves into one
+type sstableIterator struct {
+	table       *SSTable
+	block       int      // index of the loaded block
+	records     []Record // every record in the loaded block
+	pos         int
+	err         error
+	bypassCache bool
+}
+
+func newSSTableIterator(table *SSTable) *sstableIterator {
+	return &sstableIterator{table: table, pos: -1}
+}
+
+// newCompactionInputIterator is an sstableIterator that reads around the block cache, since a compaction reads every
+// block exactly once and would only push the blocks worth caching out
+func newCompactionInputIterator(table *SSTable) *sstableIterator {
+	return &sstableIterator{table: table, pos: -1, bypassCache: true}
+}
+
+func (it *sstableIterator) Seek(key string) {
+	if !it.loadBlock(it.table.findBlock(key)) {
+		return
+	}
+	it.pos = sort.Search(len(it.records), func(i int) bool { return it.records[i].Key >= key })
+	it.skipForward()
+}
+
+func (it *sstableIterator) SeekForPrev(key string) {
+	// * the last key <= key is either in the block that would hold key, or (when key is past the end) the last block
+	if !it.loadBlock(min(it.table.findBlock(key), len(it.table.blocks)-1)) {
+		return
+	}
+	it.pos = sort.Search(len(it.records), func(i int) bool { return it.records[i].Key > key }) - 1
+	it.skipBackward()
+}
+
+func (it *sstableIterator) SeekToFirst() {
+	if it.loadBlock(0) {
+		it.pos = 0
+		it.skipForward()
+	}
+}
+
+func (it *sstableIterator) SeekToLast() {
+	if it.loadBlock(len(it.table.blocks) - 1) {
+		it.pos = len(it.records) - 1
+		it.skipBackward()
+	}
+}
+
+func (it *sstableIterator) Valid() bool {
+	return it.err == nil && it.pos >= 0 && it.pos < len(it.records)
+}
+
+func (it *sstableIterator) Next() {
+	it.pos++
+	it.skipForward()
+}
+
+func (it *sstableIterator) Prev() {
+	it.pos--
+	it.skipBackward()
+}
+
+func (it *sstableIterator) Record() *Record { return &it.records[it.pos] }
+func (it *sstableIterator) Error() error    { return it.err }
+
+// loadBlock decodes the records of the i-th block, leaving the iterator invalid until pos is set
+func (it *sstableIterator) loadBlock(i int) bool {
+	it.records, it.pos = nil, -1
+	if i < 0 || i >= len(it.table.blocks) {
+		return false
+	}
+
+	readBlock := it.table.readBlock
+	if it.bypassCache {
+		readBlock = it.table.readBlockFromDisk
+	}
+	records, err := readBlock(i)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.block, it.records = i, records
+	return true
+}
+
+// skipForward moves into the following block(s) once pos runs off the end of the loaded one
+func (it *sstableIterator) skipForward() {
+	for it.err == nil && it.pos >= len(it.records) && it.block+1 < len(it.table.blocks) {
+		if it.loadBlock(it.block + 1) {
+			it.pos = 0
+		}
+	}
+}
+
+// skipBackward moves into the preceding block(s) once pos runs off the start of the loaded one
+func (it *sstableIterator) skipBackward() {
+	for it.err == nil && it.pos < 0 && it.block > 0 {
+		if it.loadBlock(it.block - 1) {
+			it.pos = len(it.records) - 1
+		}
+	}
+}
+
+type direction int
+
+const (
+	forward direction = iota
+	backward
+)
+
+// mergingIterator merges several sources into a single sorted stream with one record per key. Whenever several sources
+// hold the same key, the version with the highest sequence number wins.
+//
+// Moving forward, every child sits at its first key >= the current key. Moving backward, every child sits at its
+// last key <= the current key. Switching direction re-seeks the children to restore that.
+type mergingIterator struct {
+	children  []internalIterator
+	current   int // index of the child holding the winning record, -1 once every child is exhausted
+	direction direction
+}
+
+func newMergingIterator(children []internalIterator) *mergingIterator {
+	return &mergingIterator{children: children, current: -1}
+}
+
+func (m *mergingIterator) Seek(key string) {
+	for _, child := range m.children {
+		child.Seek(key)
+	}
+	m.direction = forward
+	m.findSmallest()
+}
+
+func (m *mergingIterator) SeekForPrev(key string) {
+	for _, child := range m.children {
+		child.SeekForPrev(key)
+	}
+	m.direction = backward
+	m.findLargest()
+}
+
+func (m *mergingIterator) SeekToFirst() {
+	for _, child := range m.children {
+		child.SeekToFirst()
+	}
+	m.direction = forward
+	m.findSmallest()
+}
+
+func (m *mergingIterator) SeekToLast() {
+	for _, child := range m.children {
+		child.SeekToLast()
+	}
+	m.direction = backward
+	m.findLargest()
+}
+
+func (m *mergingIterator) Valid() bool { return m.current >= 0 }
+
+// Next skips past the current key in every child, dropping the older versions shadowed by the winner
+func (m *mergingIterator) Next() {
+	key := m.Record().Key
+	for _, child := range m.children {
+		if m.direction == backward {
+			child.Seek(key)
+		}
+		if child.Valid() && child.Record().Key == key {
+			child.Next()
+		}
+	}
+	m.direction = forward
+	m.findSmallest()
+}
+
+// Prev mirrors Next, moving every child to before the current key
+func (m *mergingIterator) Prev() {
+	key := m.Record().Key
+	for _, child := range m.children {
+		if m.direction == forward {
+			child.SeekForPrev(key)
+		}
+		if child.Valid() && child.Record().Key == key {
+			child.Prev()
+		}
+	}
+	m.direction = backward
+	m.findLargest()
+}
+
+func (m *mergingIterator) Record() *Record { return m.children[m.current].Record() }
+
+func (m *mergingIterator) Error() error {
+	for _, child := range m.children {
+		if err := child.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mergingIterator) findSmallest() {
+	m.current = -1
+	for i, child := range m.children {
+		if child.Valid() && (m.current == -1 || m.beats(child.Record(), m.children[m.current].Record(), -1)) {
+			m.current = i
+		}
+	}
+}
+
+func (m *mergingIterator) findLargest() {
+	m.current = -1
+	for i, child := range m.children {
+		if child.Valid() && (m.current == -1 || m.beats(child.Record(), m.children[m.current].Record(), 1)) {
+			m.current = i
+		}
+	}
+}
+
+// beats reports whether record should replace best as the current record, where order is -1 when looking for the
+// smallest key and 1 when looking for the largest. Between two versions of the same key, the newer one wins.
+func (m *mergingIterator) beats(record *Record, best *Record, order int) bool {
+	if record.Key == best.Key {
+		return record.Header.SeqNum > best.Header.SeqNum
+	}
+	return strings.Compare(record.Key, best.Key) == order
+}
+
+// Iterator walks the live key, value pairs of a store in key order, in either direction, with deleted keys left out.
+// It reads from a snapshot of the memtables taken when it was created, so later writes aren't visible, and keys count
+// as expired if their TTL had run out by then.
+//
+//	it, _ := store.Scan("a", "m", 0)
+//	defer it.Close()
+//	for ; it.Valid(); it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+//
+// To get the last 10 keys before "user5":
+//
+//	it, _ := store.NewIterator()
+//	defer it.Close()
+//	it.SeekForPrev("user5")
+//	for i := 0; i < 10 && it.Valid(); i++ {
+//		fmt.Println(it.Key(), it.Value())
+//		it.Prev()
+//	}
+type Iterator struct {
+	merged *mergingIterator
+	tables []*SSTable // the tables being read, referenced until Close
+	start  string     // inclusive lower bound
+	end    string     // exclusive upper bound, empty for none
+	limit  int        // max number of pairs to return per seek, 0 for no limit
+	count  int
+	now    uint32 // when the iterator was created, in unix seconds
+}
+
+func newIterator(merged *mergingIterator, tables []*SSTable, start string, end string, limit int) *Iterator {
+	return &Iterator{merged: merged, tables: tables, start: start, end: end, limit: limit, now: uint32(time.Now().Unix())}
+}
+
+// Close releases the tables the iterator reads from, so the files of any that were compacted away since it was
+// created can be closed. The iterator can't be used afterwards.
+func (it *Iterator) Close() {
+	releaseTables(it.tables)
+	it.tables = nil
+}
+
+// Seek positions the iterator at the first pair with a key >= key
+func (it *Iterator) Seek(key string) {
+	it.count = 0
+	it.merged.Seek(max(key, it.start))
+	it.skipDeleted(forward)
+}
+
+// SeekForPrev positions the iterator at the last pair with a key <= key
+func (it *Iterator) SeekForPrev(key string) {
+	it.count = 0
+	if it.end != "" && key >= it.end {
+		it.seekBeforeEnd()
+	} else {
+		it.merged.SeekForPrev(key)
+	}
+	it.skipDeleted(backward)
+}
+
+// SeekToFirst positions the iterator at the first pair in range
+func (it *Iterator) SeekToFirst() {
+	it.Seek(it.start)
+}
+
+// SeekToLast positions the iterator at the last pair in range
+func (it *Iterator) SeekToLast() {
+	it.count = 0
+	if it.end != "" {
+		it.seekBeforeEnd()
+	} else {
+		it.merged.SeekToLast()
+	}
+	it.skipDeleted(backward)
+}
+
+// seekBeforeEnd positions the merged iterator at the last key < end
+func (it *Iterator) seekBeforeEnd() {
+	it.merged.SeekForPrev(it.end)
+	if it.merged.Valid() && it.merged.Record().Key == it.end {
+		it.merged.Prev()
+	}
+}
+
+// Valid reports whether the iterator is positioned at a pair, false once it leaves the range (or hits the limit)
+func (it *Iterator) Valid() bool {
+	if !it.merged.Valid() || it.merged.Error() != nil || (it.limit > 0 && it.count >= it.limit) {
+		return false
+	}
+	key := it.merged.Record().Key
+	return key >= it.start && (it.end == "" || key < it.end)
+}
+
+// Next moves on to the next live pair
+func (it *Iterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	it.count++
+	it.merged.Next()
+	it.skipDeleted(forward)
+}
+
+// Prev moves back to the previous live pair
+func (it *Iterator) Prev() {
+	if !it.Valid() {
+		return
+	}
+	it.count++
+	it.merged.Prev()
+	it.skipDeleted(backward)
+}
+
+func (it *Iterator) Key() string   { return it.merged.Record().Key }
+func (it *Iterator) Value() string { return it.merged.Record().Value }
+
+// Error returns the first error hit while reading from disk, which also ends the iteration
+func (it *Iterator) Error() error { return it.merged.Error() }
+
+// skipDeleted moves past tombstones and expired pairs
+func (it *Iterator) skipDeleted(dir direction) {
+	for it.merged.Valid() && it.merged.Record().Header.deleted(it.now) {
+		if dir == forward {
+			it.merged.Next()
+		} else {
+			it.merged.Prev()
+		}
+	}
+}
+
+// prefixSuccessor returns the smallest key greater than every key starting with prefix, or "" if there isn't one
+// (the prefix is empty or all 0xFF bytes)
+func prefixSuccessor(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xFF {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
@@ -11,9 +11,14 @@ import (
 /*
 The format for each key-value (including header) on disk is as follows:
 
-| CheckSum | Tombstone | TimeStamp | KeySize | ValueSize | Key | Value | RecordSize |
+| CheckSum | Tombstone | SeqNum | TimeStamp | ExpiresAt | KeySize | ValueSize | Key | Value | RecordSize |
+
+SeqNum is the store-wide sequence number of the write, and is the only thing deciding which version of a key is newer.
+TimeStamp is just the wall-clock time (in seconds) the write happened at.
+ExpiresAt is the wall-clock time (in seconds) the record expires at, 0 if it never does. An expired record reads as if
+it were deleted.
 */
-const headerSize = 17
+const headerSize = 29
 
 // KeyEntry holds metadata about the KV pair
 type KeyEntry struct {
@@ -22,11 +27,13 @@ type KeyEntry struct {
 	EntrySize     uint32
 }
 
-// Header all fields in header are of fixed size, amounting to 17 bytes total
+// Header all fields in header are of fixed size, amounting to 29 bytes total
 type Header struct {
 	CheckSum  uint32
 	Tombstone uint8
+	SeqNum    uint64
 	TimeStamp uint32
+	ExpiresAt uint32
 	KeySize   uint32
 	ValueSize uint32
 }
@@ -66,10 +73,18 @@ func (h *Header) EncodeHeader(buf *bytes.Buffer) error {
 	if err != nil {
 		return utils.ErrEncodingHeaderFailed
 	}
+	err = binary.Write(buf, binary.LittleEndian, &h.SeqNum)
+	if err != nil {
+		return utils.ErrEncodingHeaderFailed
+	}
 	err = binary.Write(buf, binary.LittleEndian, &h.TimeStamp)
 	if err != nil {
 		return utils.ErrEncodingHeaderFailed
 	}
+	err = binary.Write(buf, binary.LittleEndian, &h.ExpiresAt)
+	if err != nil {
+		return utils.ErrEncodingHeaderFailed
+	}
 	err = binary.Write(buf, binary.LittleEndian, &h.KeySize)
 	if err != nil {
 		return utils.ErrEncodingHeaderFailed
@@ -92,15 +107,23 @@ func (h *Header) DecodeHeader(buf []byte) error {
 	if err != nil {
 		return utils.ErrEncodingHeaderFailed
 	}
-	_, err = binary.Decode(buf[5:9], binary.LittleEndian, &h.TimeStamp)
+	_, err = binary.Decode(buf[5:13], binary.LittleEndian, &h.SeqNum)
+	if err != nil {
+		return utils.ErrEncodingHeaderFailed
+	}
+	_, err = binary.Decode(buf[13:17], binary.LittleEndian, &h.TimeStamp)
 	if err != nil {
 		return utils.ErrEncodingHeaderFailed
 	}
-	_, err = binary.Decode(buf[9:13], binary.LittleEndian, &h.KeySize)
+	_, err = binary.Decode(buf[17:21], binary.LittleEndian, &h.ExpiresAt)
 	if err != nil {
 		return utils.ErrEncodingHeaderFailed
 	}
-	_, err = binary.Decode(buf[13:17], binary.LittleEndian, &h.ValueSize)
+	_, err = binary.Decode(buf[21:25], binary.LittleEndian, &h.KeySize)
+	if err != nil {
+		return utils.ErrEncodingHeaderFailed
+	}
+	_, err = binary.Decode(buf[25:29], binary.LittleEndian, &h.ValueSize)
 	if err != nil {
 		return utils.ErrEncodingHeaderFailed
 	}
@@ -112,6 +135,16 @@ func (h *Header) MarkTombstone() {
 	h.Tombstone = 1
 }
 
+// expired reports whether the record's TTL ran out at or before now (in unix seconds)
+func (h *Header) expired(now uint32) bool {
+	return h.ExpiresAt != 0 && h.ExpiresAt <= now
+}
+
+// deleted reports whether the record hides its key, either because it's a tombstone or because it expired
+func (h *Header) deleted(now uint32) bool {
+	return h.Tombstone == 1 || h.expired(now)
+}
+
 func (r *Record) EncodeKV(buf *bytes.Buffer) error {
 	// write the KV data into the buffer
 	err := r.Header.EncodeHeader(buf)
@@ -142,10 +175,18 @@ func (r *Record) CalculateChecksum() (uint32, error) {
 	if err != nil {
 		return 0, err
 	}
+	err = binary.Write(headerBuf, binary.LittleEndian, &r.Header.SeqNum)
+	if err != nil {
+		return 0, err
+	}
 	err = binary.Write(headerBuf, binary.LittleEndian, &r.Header.TimeStamp)
 	if err != nil {
 		return 0, err
 	}
+	err = binary.Write(headerBuf, binary.LittleEndian, &r.Header.ExpiresAt)
+	if err != nil {
+		return 0, err
+	}
 	err = binary.Write(headerBuf, binary.LittleEndian, &r.Header.KeySize)
 	if err != nil {
 		return 0, err
@@ -0,0 +1,207 @@
+package store
+
+import (
+	"cmp"
+	"slices"
+)
+
+// leveledCompaction flushes into level 1, where tables may overlap, and keeps every level after that a sorted run of
+// non-overlapping tables. Level 1 is merged into level 2 once it holds level1Trigger tables, and any other level is
+// merged one table at a time into the next once it outgrows its target size.
+type leveledCompaction struct {
+	tables        map[int][]*SSTable // levels past 1 are sorted by minKey
+	highestLvl    int
+	level1Trigger int
+	baseSize      uint64 // target size of level 2, every level after it is multiplier times bigger
+	multiplier    uint64
+	tableSize     uint32 // compactions split their output into tables of about this size
+}
+
+// DefaultLevelSizeMultiplier is how many times bigger each level is than the one before it under LeveledCompaction
+const DefaultLevelSizeMultiplier = 10
+
+func newLeveledCompaction(flushSizeThreshold uint32, multiplier int, tableSize uint32) *leveledCompaction {
+	if multiplier < 2 {
+		multiplier = DefaultLevelSizeMultiplier
+	}
+	if tableSize == 0 {
+		tableSize = flushSizeThreshold
+	}
+	lc := &leveledCompaction{
+		tables:        make(map[int][]*SSTable),
+		highestLvl:    1,
+		level1Trigger: 4,
+		multiplier:    uint64(multiplier),
+		tableSize:     tableSize,
+	}
+	// * level 2 can hold about what a level 1 compaction brings into it
+	lc.baseSize = uint64(lc.level1Trigger) * uint64(flushSizeThreshold)
+	return lc
+}
+
+func (lc *leveledCompaction) Name() string {
+	return LeveledCompaction.String()
+}
+
+func (lc *leveledCompaction) addTable(table *SSTable) int {
+	lc.tables[1] = append(lc.tables[1], table)
+	return 1
+}
+
+// restoreTable puts the table back at its level. A table overlapping the ones already there (e.g. from a store that
+// used to be size-tiered) goes to level 1 instead, the only level allowed to overlap, and gets compacted down from there.
+func (lc *leveledCompaction) restoreTable(table *SSTable, level int) {
+	if level > 1 && slices.ContainsFunc(lc.tables[level], func(other *SSTable) bool {
+		return other.overlaps(table.minKey, table.maxKey)
+	}) {
+		level = 1
+	}
+	lc.insert(table, level)
+}
+
+// pickCompaction compacts whichever level is the furthest over its target (and isn't blocked by running compactions).
+// Level 1 is merged into level 2 as a whole, while for any other level, the table overlapping the fewest bytes in the
+// next level is merged down into it.
+func (lc *leveledCompaction) pickCompaction(running []*compaction) *compaction {
+	busy := busyTables(running)
+	type levelScore struct {
+		lvl   int
+		score float64
+	}
+	var scores []levelScore
+	for lvl := 1; lvl <= lc.highestLvl; lvl++ {
+		var score float64
+		if lvl == 1 {
+			idle := slices.DeleteFunc(slices.Clone(lc.tables[1]), func(table *SSTable) bool {
+				return busy[table.sstCounter]
+			})
+			score = float64(len(idle)) / float64(lc.level1Trigger)
+		} else {
+			score = float64(levelSize(lc.tables[lvl])) / float64(lc.targetSize(lvl))
+		}
+		if score >= 1 {
+			scores = append(scores, levelScore{lvl, score})
+		}
+	}
+	slices.SortStableFunc(scores, func(a, b levelScore) int {
+		return cmp.Compare(b.score, a.score)
+	})
+
+	for _, s := range scores {
+		if c := lc.compactionFor(s.lvl, busy, running); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// compactionFor picks the tables to merge from lvl into the next level, or returns nil if every candidate overlaps a
+// running compaction
+func (lc *leveledCompaction) compactionFor(lvl int, busy map[uint32]bool, running []*compaction) *compaction {
+	var candidates [][]*SSTable
+	if lvl == 1 {
+		idle := slices.DeleteFunc(slices.Clone(lc.tables[1]), func(table *SSTable) bool {
+			return busy[table.sstCounter]
+		})
+		candidates = append(candidates, idle)
+	} else {
+		for _, table := range lc.tables[lvl] {
+			if !busy[table.sstCounter] {
+				candidates = append(candidates, []*SSTable{table})
+			}
+		}
+	}
+
+	// * of every candidate that can run, go with the one overlapping the fewest bytes in the next level, so it's the
+	// * cheapest to merge down
+	var best *compaction
+	var bestOverlap uint64
+	for _, inputs := range candidates {
+		minKey, maxKey := keyRange(inputs)
+		overlapping := lc.overlapping(lvl+1, minKey, maxKey)
+		if slices.ContainsFunc(overlapping, func(table *SSTable) bool { return busy[table.sstCounter] }) {
+			continue
+		}
+		// * two compactions writing overlapping tables into the same level would break its ordering
+		if slices.ContainsFunc(running, func(other *compaction) bool {
+			otherMin, otherMax := keyRange(other.inputs)
+			return other.outputLevel == lvl+1 && otherMin <= maxKey && otherMax >= minKey
+		}) {
+			continue
+		}
+		if overlap := levelSize(overlapping); best == nil || overlap < bestOverlap {
+			best = &compaction{inputs: append(slices.Clone(inputs), overlapping...), outputLevel: lvl + 1, targetFileSize: lc.tableSize}
+			bestOverlap = overlap
+		}
+	}
+	return best
+}
+
+// finishCompaction drops the inputs from their levels and puts the outputs in the level they were merged into
+func (lc *leveledCompaction) finishCompaction(c *compaction, outputs []*SSTable) []int {
+	for lvl, tables := range lc.tables {
+		lc.tables[lvl] = slices.DeleteFunc(tables, func(table *SSTable) bool {
+			return slices.Contains(c.inputs, table)
+		})
+	}
+
+	levels := make([]int, len(outputs))
+	for i, output := range outputs {
+		lc.insert(output, c.outputLevel)
+		levels[i] = c.outputLevel
+	}
+	return levels
+}
+
+func (lc *leveledCompaction) levels() map[int][]*SSTable {
+	return lc.tables
+}
+
+// insert adds the table to lvl, keeping levels past 1 sorted by key
+func (lc *leveledCompaction) insert(table *SSTable, lvl int) {
+	lc.highestLvl = max(lc.highestLvl, lvl)
+	lc.tables[lvl] = append(lc.tables[lvl], table)
+	if lvl > 1 {
+		slices.SortFunc(lc.tables[lvl], func(a, b *SSTable) int {
+			return cmp.Compare(a.minKey, b.minKey)
+		})
+	}
+}
+
+// overlapping returns the tables in lvl holding any key in [minKey, maxKey]
+func (lc *leveledCompaction) overlapping(lvl int, minKey string, maxKey string) []*SSTable {
+	var tables []*SSTable
+	for _, table := range lc.tables[lvl] {
+		if table.overlaps(minKey, maxKey) {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// targetSize is how many bytes lvl should hold at most, levels past 1 only
+func (lc *leveledCompaction) targetSize(lvl int) uint64 {
+	size := lc.baseSize
+	for i := 2; i < lvl; i++ {
+		size *= lc.multiplier
+	}
+	return size
+}
+
+func levelSize(tables []*SSTable) uint64 {
+	var size uint64
+	for _, table := range tables {
+		size += uint64(table.sizeInBytes)
+	}
+	return size
+}
+
+// keyRange returns the smallest and largest key across tables
+func keyRange(tables []*SSTable) (string, string) {
+	minKey, maxKey := tables[0].minKey, tables[0].maxKey
+	for _, table := range tables[1:] {
+		minKey = min(minKey, table.minKey)
+		maxKey = max(maxKey, table.maxKey)
+	}
+	return minKey, maxKey
+}
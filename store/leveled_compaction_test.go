@@ -0,0 +1,146 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/tferdous17/genesis/utils"
+)
+
+func TestLeveledCompaction(t *testing.T) {
+	logDir, storageDir := t.TempDir(), t.TempDir()
+	opts := asyncStoreOptions()
+	opts.FlushSizeThreshold = 512
+	opts.Compaction = LeveledCompaction
+	opts.LevelSizeMultiplier = 4
+	store, err := openStore(logDir, storageDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// * overwrite and delete keys all over the key space so every level ends up with overlapping work
+	rng := rand.New(rand.NewSource(1))
+	expected := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("user%03d", rng.Intn(400))
+		if i%10 == 0 {
+			if err := store.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			delete(expected, key)
+			continue
+		}
+		val := fmt.Sprintf("hero%d", i)
+		if err := store.Put(&key, &val); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = val
+	}
+
+	checkLevels(t, store)
+	if lc := store.bucketManager.strategy.(*leveledCompaction); lc.highestLvl < 3 {
+		t.Fatalf("expected tables to be pushed down past level 2, got %d levels", lc.highestLvl)
+	}
+	checkContents(t, store, expected)
+
+	if !store.Close() {
+		t.Fatal("failed to close store")
+	}
+	reopened, err := openStore(logDir, storageDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLevels(t, reopened)
+	checkContents(t, reopened, expected)
+}
+
+func TestLeveledCompaction_SwitchFromSizeTiered(t *testing.T) {
+	logDir, storageDir := t.TempDir(), t.TempDir()
+	opts := DefaultStoreOptions()
+	opts.FlushSizeThreshold = 512
+	store, err := openStore(logDir, storageDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string]string)
+	for i := 0; i < 600; i++ {
+		key, val := fmt.Sprintf("user%03d", i%150), fmt.Sprintf("hero%d", i)
+		if err := store.Put(&key, &val); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = val
+	}
+	if !store.Close() {
+		t.Fatal("failed to close store")
+	}
+
+	// * the size-tiered levels overlap, so the leveled strategy has to pull them back into level 1. none of that may
+	// * start before the store is fully open, since compactions edit the manifest it's still reading from
+	opts.Compaction = LeveledCompaction
+	manifest, err := openManifest(storageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bm, err := openBucketManager(storageDir, manifest, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bm.strategy.pickCompaction(nil) == nil {
+		t.Fatal("expected the reopened tables to need compacting")
+	}
+	if len(bm.running) != 0 {
+		t.Fatalf("expected no compactions before the store is open, got %d", len(bm.running))
+	}
+	if err := bm.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openStore(logDir, storageDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLevels(t, reopened)
+	checkContents(t, reopened, expected)
+}
+
+// checkLevels fails unless every level past 1 is sorted, non-overlapping and within its target size (the last level
+// has no target)
+func checkLevels(t *testing.T, store *DiskStore) {
+	t.Helper()
+	if err := store.FlushMemtable(); err != nil {
+		t.Fatal(err)
+	}
+	store.bucketManager.waitForCompactions()
+	lc := store.bucketManager.strategy.(*leveledCompaction)
+	if len(lc.tables[1]) >= lc.level1Trigger {
+		t.Fatalf("expected fewer than %d tables in level 1, got %d", lc.level1Trigger, len(lc.tables[1]))
+	}
+	for lvl := 2; lvl <= lc.highestLvl; lvl++ {
+		tables := lc.tables[lvl]
+		for i := 1; i < len(tables); i++ {
+			if tables[i-1].maxKey >= tables[i].minKey {
+				t.Fatalf("level %d: table [%s, %s] overlaps [%s, %s]", lvl, tables[i-1].minKey, tables[i-1].maxKey, tables[i].minKey, tables[i].maxKey)
+			}
+		}
+		if lvl < lc.highestLvl && levelSize(tables) > lc.targetSize(lvl) {
+			t.Fatalf("level %d: expected at most %d bytes, got %d", lvl, lc.targetSize(lvl), levelSize(tables))
+		}
+	}
+}
+
+func checkContents(t *testing.T, store *DiskStore, expected map[string]string) {
+	t.Helper()
+	for i := 0; i < 400; i++ {
+		key := fmt.Sprintf("user%03d", i)
+		val, err := store.Get(key)
+		if want, found := expected[key]; found {
+			if err != nil || val != want {
+				t.Fatalf("expected %s = %s, got %q (err = %v)", key, want, val, err)
+			}
+		} else if !errors.Is(err, utils.ErrKeyNotFound) {
+			t.Fatalf("expected %s to be deleted, got %q (err = %v)", key, val, err)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package store
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/tferdous17/genesis/utils"
+)
+
+/*
+The MANIFEST is an edit log recording which SSTables make up a store. It starts with
+
+| Magic | Version |
+
+followed by one frame (see frame.go) per version edit. Each edit is applied atomically and looks like:
+
+| NextTableNum | LastSeqNum | NumAdded | (TableNum | MaxSeqNum | Level | Run | SizeInBytes | MinKeySize | MinKey | MaxKeySize | MaxKey)... | NumRemoved | TableNum... |
+
+LastSeqNum is the highest sequence number ever flushed to a table, so the store's sequence numbers keep increasing
+across restarts even once compaction has thrown away the records that carried them. Run is the first table number
+written by the compaction a table came out of (0 for one of its own), so size-tiered compaction keeps a merge's tables
+together. Manifests older than version 5 can't be read anymore: before version 3 they describe tables without sequence
+numbers, version 3 frames lack the length CRC, and version 4 tables lack their run.
+
+Replaying every edit in order gives the current set of live tables. The log is rewritten as a single snapshot edit
+every time the store is opened so it doesn't grow forever.
+*/
+const (
+	ManifestFilename = "MANIFEST"
+	// LostDirectory (under the storage directory) is where table files the manifest doesn't list are moved when they
+	// can't be proven to be garbage
+	LostDirectory = "lost"
+
+	manifestMagic   uint32 = 0x4E414D47 // "GMAN"
+	manifestVersion uint32 = 5
+
+	manifestPreambleSize = 8
+)
+
+// tableMeta is everything the manifest knows about a live SSTable
+type tableMeta struct {
+	tableNum    uint32
+	maxSeqNum   uint64
+	level       int
+	run         uint32
+	sizeInBytes uint32
+	minKey      string
+	maxKey      string
+}
+
+// versionEdit is a set of table additions and removals that gets applied as a whole
+type versionEdit struct {
+	nextTableNum uint32
+	lastSeqNum   uint64
+	added        []tableMeta
+	removed      []uint32
+}
+
+type manifest struct {
+	mu           sync.Mutex
+	directory    string
+	file         *os.File
+	tables       map[uint32]tableMeta
+	nextTableNum uint32
+	lastSeqNum   uint64
+	tornTail     bool // replay stopped at a torn edit rather than the end of the log
+}
+
+// openManifest replays the MANIFEST in directory (creating it if it doesn't exist yet) and then compacts it down to
+// a single snapshot of the live tables
+func openManifest(directory string) (*manifest, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	m := &manifest{
+		directory:    directory,
+		tables:       make(map[uint32]tableMeta),
+		nextTableNum: 1,
+	}
+	if err := m.replay(); err != nil {
+		return nil, err
+	}
+	if err := m.rewrite(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *manifest) replay() error {
+	path := filepath.Join(m.directory, ManifestFilename)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(data) < manifestPreambleSize || binary.LittleEndian.Uint32(data[:4]) != manifestMagic {
+		return fmt.Errorf("%w: %s is not a manifest", utils.ErrManifestCorrupted, path)
+	}
+	version := binary.LittleEndian.Uint32(data[4:8])
+	if version != manifestVersion {
+		return fmt.Errorf("%w: %s has version %d", utils.ErrUnsupportedManifestVersion, path, version)
+	}
+
+	offset := manifestPreambleSize
+	for offset < len(data) {
+		payload, frameSize, err := decodeFrame(data[offset:])
+		if errors.Is(err, errTornWrite) {
+			// the edit never finished, so whatever it described never took effect
+			utils.LogYELLOW("MANIFEST: torn write at offset %d, discarding tail", offset)
+			m.tornTail = true
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s at offset %d: %w", utils.ErrManifestCorrupted, path, offset, err)
+		}
+
+		edit, err := decodeVersionEdit(payload)
+		if err != nil {
+			return fmt.Errorf("%w: %s at offset %d: %w", utils.ErrManifestCorrupted, path, offset, err)
+		}
+		m.apply(edit)
+		offset += frameSize
+	}
+
+	return nil
+}
+
+func (m *manifest) apply(edit *versionEdit) {
+	for _, tableNum := range edit.removed {
+		delete(m.tables, tableNum)
+	}
+	for _, meta := range edit.added {
+		m.tables[meta.tableNum] = meta
+		m.lastSeqNum = max(m.lastSeqNum, meta.maxSeqNum)
+	}
+	m.nextTableNum = max(m.nextTableNum, edit.nextTableNum)
+	m.lastSeqNum = max(m.lastSeqNum, edit.lastSeqNum)
+}
+
+// rewrite writes the current state out as a brand-new manifest and atomically swaps it in
+func (m *manifest) rewrite() error {
+	path := filepath.Join(m.directory, ManifestFilename)
+	tmpPath := path + ".tmp"
+
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, manifestMagic)
+	_ = binary.Write(buf, binary.LittleEndian, manifestVersion)
+	snapshot := &versionEdit{nextTableNum: m.nextTableNum, lastSeqNum: m.lastSeqNum, added: m.liveTables()}
+	buf.Write(encodeFrame(snapshot.encode()))
+
+	if err := utils.WriteToFile(buf.Bytes(), tmpFile); err != nil {
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	if m.file != nil {
+		if err := m.file.Close(); err != nil {
+			return err
+		}
+	}
+	m.file = file
+
+	return nil
+}
+
+// logEdit durably appends the edit to the manifest, then applies it
+func (m *manifest) logEdit(edit *versionEdit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	edit.nextTableNum = m.nextTableNum
+	edit.lastSeqNum = m.lastSeqNum
+	for _, meta := range edit.added {
+		edit.lastSeqNum = max(edit.lastSeqNum, meta.maxSeqNum)
+	}
+	if err := utils.WriteToFile(encodeFrame(edit.encode()), m.file); err != nil {
+		return err
+	}
+	m.apply(edit)
+
+	return nil
+}
+
+// allocateTableNum hands out the number for a new SSTable. It only becomes durable along with the edit that adds
+// the table, so a crash in between at worst reuses the number for an orphaned file.
+func (m *manifest) allocateTableNum() uint32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tableNum := m.nextTableNum
+	m.nextTableNum++
+	return tableNum
+}
+
+// liveTables returns every table currently in the store, oldest first
+func (m *manifest) liveTables() []tableMeta {
+	tables := make([]tableMeta, 0, len(m.tables))
+	for _, meta := range m.tables {
+		tables = append(tables, meta)
+	}
+	slices.SortFunc(tables, func(a, b tableMeta) int {
+		return cmp.Compare(a.tableNum, b.tableNum)
+	})
+	return tables
+}
+
+func (m *manifest) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.file.Close()
+}
+
+// removeOrphanedTables deletes any SSTable files in directory that the manifest doesn't know about, e.g. the output
+// of a compaction that crashed before it was recorded.
+//
+// If the manifest's replay stopped at a torn edit, the manifest may be missing more than that one edit's tables, so
+// nothing is deleted: the files it doesn't list are moved to LostDirectory instead, for an operator to inspect.
+// (A manifest that's corrupted rather than torn never gets this far, since openManifest fails.)
+func removeOrphanedTables(directory string, m *manifest) error {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return err
+	}
+
+	lostDirectory := filepath.Join(directory, LostDirectory)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		var tableNum uint32
+		if _, err := fmt.Sscanf(entry.Name(), "sst_%d.", &tableNum); err != nil {
+			continue
+		}
+		if _, live := m.tables[tableNum]; live {
+			continue
+		}
+
+		path := filepath.Join(directory, entry.Name())
+		if m.tornTail {
+			if err := os.MkdirAll(lostDirectory, 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(path, filepath.Join(lostDirectory, entry.Name())); err != nil {
+				return err
+			}
+			utils.LogYELLOW("MANIFEST: moved unrecorded table file %s to %s", entry.Name(), lostDirectory)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		utils.LogYELLOW("MANIFEST: removed orphaned table file %s", entry.Name())
+	}
+	return nil
+}
+
+func newTableMeta(table *SSTable, level int) tableMeta {
+	return tableMeta{
+		tableNum:    table.sstCounter,
+		maxSeqNum:   table.maxSeqNum,
+		level:       level,
+		run:         table.run,
+		sizeInBytes: table.sizeInBytes,
+		minKey:      table.minKey,
+		maxKey:      table.maxKey,
+	}
+}
+
+func (e *versionEdit) encode() []byte {
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, e.nextTableNum)
+	_ = binary.Write(buf, binary.LittleEndian, e.lastSeqNum)
+
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(e.added)))
+	for _, meta := range e.added {
+		_ = binary.Write(buf, binary.LittleEndian, meta.tableNum)
+		_ = binary.Write(buf, binary.LittleEndian, meta.maxSeqNum)
+		_ = binary.Write(buf, binary.LittleEndian, uint32(meta.level))
+		_ = binary.Write(buf, binary.LittleEndian, meta.run)
+		_ = binary.Write(buf, binary.LittleEndian, meta.sizeInBytes)
+		_ = binary.Write(buf, binary.LittleEndian, uint32(len(meta.minKey)))
+		buf.WriteString(meta.minKey)
+		_ = binary.Write(buf, binary.LittleEndian, uint32(len(meta.maxKey)))
+		buf.WriteString(meta.maxKey)
+	}
+
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(e.removed)))
+	for _, tableNum := range e.removed {
+		_ = binary.Write(buf, binary.LittleEndian, tableNum)
+	}
+
+	return buf.Bytes()
+}
+
+func decodeVersionEdit(payload []byte) (*versionEdit, error) {
+	reader := bytes.NewReader(payload)
+	edit := &versionEdit{}
+
+	readUint32 := func() uint32 {
+		var v uint32
+		_ = binary.Read(reader, binary.LittleEndian, &v)
+		return v
+	}
+	readUint64 := func() uint64 {
+		var v uint64
+		_ = binary.Read(reader, binary.LittleEndian, &v)
+		return v
+	}
+	readString := func() string {
+		size := readUint32()
+		if int(size) > reader.Len() {
+			return ""
+		}
+		b := make([]byte, size)
+		_, _ = reader.Read(b)
+		return string(b)
+	}
+
+	edit.nextTableNum = readUint32()
+	edit.lastSeqNum = readUint64()
+	numAdded := readUint32()
+	for i := uint32(0); i < numAdded && reader.Len() > 0; i++ {
+		meta := tableMeta{tableNum: readUint32(), maxSeqNum: readUint64()}
+		meta.level = int(readUint32())
+		meta.run = readUint32()
+		meta.sizeInBytes = readUint32()
+		meta.minKey = readString()
+		meta.maxKey = readString()
+		edit.added = append(edit.added, meta)
+	}
+	numRemoved := readUint32()
+	for i := uint32(0); i < numRemoved && reader.Len() > 0; i++ {
+		edit.removed = append(edit.removed, readUint32())
+	}
+
+	if len(edit.added) != int(numAdded) || len(edit.removed) != int(numRemoved) || reader.Len() != 0 {
+		return nil, fmt.Errorf("malformed version edit")
+	}
+	return edit, nil
+}
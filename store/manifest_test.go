@@ -0,0 +1,192 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tferdous17/genesis/utils"
+)
+
+func TestDiskStore_ReopenTablesFromManifest(t *testing.T) {
+	logDir, storageDir := t.TempDir(), t.TempDir()
+	opts := DefaultStoreOptions()
+	opts.FlushSizeThreshold = 512
+
+	store, err := openStore(logDir, storageDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		key, val := fmt.Sprintf("user%03d", i), fmt.Sprintf("hero%d", i)
+		if err := store.Put(&key, &val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := tablesByNum(t, store)
+	if len(before) == 0 {
+		t.Fatal("expected some tables to be flushed")
+	}
+	if !store.Close() {
+		t.Fatal("failed to close store")
+	}
+
+	reopened, err := openStore(logDir, storageDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := tablesByNum(t, reopened)
+	if len(after) != len(before) {
+		t.Fatalf("expected %d tables after reopening, got %d", len(before), len(after))
+	}
+	for tableNum, lvl := range before {
+		if after[tableNum] != lvl {
+			t.Fatalf("expected table %d at level %d, got level %d", tableNum, lvl, after[tableNum])
+		}
+		if _, err := os.Stat(getNextSstFilename(storageDir, tableNum) + SSTableFileExtension); err != nil {
+			t.Fatalf("expected file for live table %d: %v", tableNum, err)
+		}
+	}
+
+	// new tables must never reuse the number of a live one
+	if next := reopened.bucketManager.allocateTableNum(); after[next] != 0 {
+		t.Fatalf("allocated table number %d is already live", next)
+	}
+}
+
+func TestManifest_TornEditIsDiscarded(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := openManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.logEdit(&versionEdit{added: []tableMeta{{tableNum: m.allocateTableNum(), level: 1, minKey: "a", maxKey: "m"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.logEdit(&versionEdit{added: []tableMeta{{tableNum: m.allocateTableNum(), level: 2, minKey: "n", maxKey: "z"}}, removed: []uint32{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// cut the second edit in half, as if the process died while writing it
+	path := dir + "/" + ManifestFilename
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := reopened.liveTables()
+	if len(live) != 1 || live[0].tableNum != 1 || live[0].level != 1 {
+		t.Fatalf("expected only table 1 to be live, got %+v", live)
+	}
+}
+
+func TestDiskStore_CorruptedManifestKeepsTables(t *testing.T) {
+	logDir, storageDir := t.TempDir(), t.TempDir()
+	opts := DefaultStoreOptions()
+	opts.FlushSizeThreshold = 512
+
+	store, err := openStore(logDir, storageDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		key, val := fmt.Sprintf("user%03d", i), fmt.Sprintf("hero%d", i)
+		if err := store.Put(&key, &val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tables := tablesByNum(t, store)
+	if len(tables) < 2 {
+		t.Fatalf("expected several tables to be flushed, got %d", len(tables))
+	}
+	if !store.Close() {
+		t.Fatal("failed to close store")
+	}
+
+	// flip a byte in the length of the first edit, which would otherwise claim the rest of the log as its own
+	path := filepath.Join(storageDir, ManifestFilename)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[manifestPreambleSize+2] ^= 0xFF
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openStore(logDir, storageDir, opts); !errors.Is(err, utils.ErrManifestCorrupted) {
+		t.Fatalf("expected ErrManifestCorrupted, got %v", err)
+	}
+	for tableNum := range tables {
+		if _, err := os.Stat(getNextSstFilename(storageDir, tableNum) + SSTableFileExtension); err != nil {
+			t.Fatalf("expected file for table %d to survive a corrupted manifest: %v", tableNum, err)
+		}
+	}
+}
+
+func TestDiskStore_TornManifestMovesTablesAside(t *testing.T) {
+	logDir, storageDir := t.TempDir(), t.TempDir()
+
+	store, err := openStore(logDir, storageDir, DefaultStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, val := "user1", "batman"
+	if err := store.Put(&key, &val); err != nil {
+		t.Fatal(err)
+	}
+	tables := tablesByNum(t, store)
+	if !store.Close() {
+		t.Fatal("failed to close store")
+	}
+
+	// cut the edit recording the flushed table in half
+	path := filepath.Join(storageDir, ManifestFilename)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openStore(logDir, storageDir, DefaultStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	for tableNum := range tables {
+		name := filepath.Base(getNextSstFilename(storageDir, tableNum)) + SSTableFileExtension
+		if _, err := os.Stat(filepath.Join(storageDir, LostDirectory, name)); err != nil {
+			t.Fatalf("expected unrecorded table %d to be moved aside: %v", tableNum, err)
+		}
+	}
+}
+
+func tablesByNum(t *testing.T, store *DiskStore) map[uint32]int {
+	t.Helper()
+	if err := store.FlushMemtable(); err != nil {
+		t.Fatal(err)
+	}
+	store.bucketManager.waitForCompactions()
+	tables := make(map[uint32]int)
+	for lvl, level := range store.bucketManager.strategy.levels() {
+		for _, table := range level {
+			tables[table.sstCounter] = lvl
+		}
+	}
+	return tables
+}
@@ -11,12 +11,12 @@ import (
 type Memtable struct {
 	data        *rbt.Tree
 	sizeInBytes uint32
+	walSegment  uint64 // last WAL segment holding this memtable's operations, only set once it's rotated out
 }
 
 func NewMemtable() *Memtable {
 	return &Memtable{
-		rbt.NewWithStringComparator(),
-		0,
+		data: rbt.NewWithStringComparator(),
 	}
 }
 
@@ -48,14 +48,9 @@ func (m *Memtable) PrintAllRecords() {
 	fmt.Println(m.returnAllRecordsInSortedOrder())
 }
 
-func (m *Memtable) Flush(directory string) *SSTable {
+func (m *Memtable) Flush(directory string, tableNum uint32, compression Compression, filterPolicy FilterPolicy) (*SSTable, error) {
 	sortedEntries := m.returnAllRecordsInSortedOrder()
-	table, err := InitSSTableOnDisk(directory, castToRecordSlice(&sortedEntries))
-	if err != nil {
-		panic(err)
-	}
-
-	return table
+	return InitSSTableOnDisk(directory, tableNum, castToRecordSlice(&sortedEntries), compression, filterPolicy)
 }
 
 func (m *Memtable) returnAllRecordsInSortedOrder() []interface{} {
@@ -63,6 +58,26 @@ func (m *Memtable) returnAllRecordsInSortedOrder() []interface{} {
 	return data
 }
 
+// recordsInRange returns the records with a key in [start, end) in sorted order. An empty end means no upper bound.
+func (m *Memtable) recordsInRange(start string, end string) []Record {
+	var node *rbt.Node
+	if start == "" {
+		node = m.data.Left()
+	} else {
+		node, _ = m.data.Ceiling(start)
+	}
+	if node == nil {
+		return nil
+	}
+
+	var records []Record
+	it := m.data.IteratorAt(node)
+	for ok := true; ok && (end == "" || it.Key().(string) < end); ok = it.Next() {
+		records = append(records, it.Value().(Record))
+	}
+	return records
+}
+
 func inorderRBT(node *rbt.Node, data []interface{}) []interface{} {
 	if node != nil {
 		data = inorderRBT(node.Left, data)
@@ -72,12 +87,6 @@ func inorderRBT(node *rbt.Node, data []interface{}) []interface{} {
 	return data
 }
 
-func (m *Memtable) clear() {
-	// clear memtable once flushed to SSTable
-	m.data.Clear()
-	m.sizeInBytes = 0
-}
-
 func castToRecordSlice(interfaceSlice *[]interface{}) *[]Record {
 	recordSlice := make([]Record, len(*interfaceSlice))
 	for i, iface := range *interfaceSlice {
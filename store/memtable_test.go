@@ -1,9 +1,38 @@
 package store
 
 import (
+	"fmt"
 	"testing"
 )
 
+func TestMemtable_RecordsInRange(t *testing.T) {
+	memtable := NewMemtable()
+	for i := 0; i < 20; i += 2 {
+		key := fmt.Sprintf("user%02d", i)
+		memtable.Put(&key, &Record{Key: key})
+	}
+
+	keys := func(records []Record) string {
+		var s string
+		for _, r := range records {
+			s += r.Key + " "
+		}
+		return s
+	}
+	for _, tc := range []struct{ start, end, want string }{
+		{"user03", "user09", "user04 user06 user08 "},
+		{"user04", "user08", "user04 user06 "},
+		{"", "user03", "user00 user02 "},
+		{"user15", "", "user16 user18 "},
+		{"user19", "", ""},
+		{"user05", "user06", ""},
+	} {
+		if got := keys(memtable.recordsInRange(tc.start, tc.end)); got != tc.want {
+			t.Fatalf("[%q, %q): expected %q, got %q", tc.start, tc.end, tc.want, got)
+		}
+	}
+}
+
 func BenchmarkMemtable_Put(b *testing.B) {
 	memtable := NewMemtable()
 
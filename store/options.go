@@ -0,0 +1,87 @@
+package store
+
+import "time"
+
+// WALDurability determines when a write is considered durable, and therefore when Put/Delete are allowed to return
+type WALDurability int
+
+const (
+	// SyncEveryWrite fsyncs the WAL before every write returns. Safest, but slowest.
+	SyncEveryWrite WALDurability = iota
+	// GroupCommit lets concurrent writers share a single fsync. The first writer to wait becomes the leader and
+	// holds the group open for GroupCommitInterval (or until GroupCommitSize bytes are queued), then syncs on
+	// behalf of everyone that joined.
+	GroupCommit
+	// Async returns immediately and only writes the WAL once WALBatchThreshold bytes are queued (or the store
+	// is closed), so acknowledged writes can be lost on a crash.
+	Async
+)
+
+func (d WALDurability) String() string {
+	switch d {
+	case SyncEveryWrite:
+		return "sync"
+	case GroupCommit:
+		return "group-commit"
+	case Async:
+		return "async"
+	default:
+		return "unknown"
+	}
+}
+
+// StoreOptions holds per-store tunables
+type StoreOptions struct {
+	Durability          WALDurability
+	GroupCommitInterval time.Duration
+	GroupCommitSize     int
+
+	// FlushSizeThreshold is how big (in bytes) the memtable can get before it's rotated out and flushed to disk
+	FlushSizeThreshold uint32
+	// MaxImmutableMemtables is how many rotated out memtables can be queued up for the background flusher (at least 1)
+	// before writes stall and wait for it to catch up
+	MaxImmutableMemtables int
+
+	// Compression is the codec new SSTables compress their data blocks with. Changing it only affects tables
+	// written from then on, existing ones stay readable.
+	Compression Compression
+
+	// FilterPolicy builds the filters of new SSTables. Like Compression, changing it doesn't affect existing tables.
+	FilterPolicy FilterPolicy
+
+	// Compaction picks how tables are arranged and merged. Like the Cassandra and LevelDB options it's based off,
+	// it's meant to be picked once per store, a store reopened with a different one has its tables rearranged.
+	Compaction CompactionStyle
+	// LevelSizeMultiplier is how many times bigger each level is than the one before it under LeveledCompaction
+	LevelSizeMultiplier int
+	// TargetFileSize is how big (in bytes) the tables written by compactions get before their output is split into
+	// another one, 0 uses FlushSizeThreshold
+	TargetFileSize uint32
+	// MaxBackgroundCompactions is how many compactions can run at once (at least 1). They run in the background, so
+	// writes never wait on them.
+	MaxBackgroundCompactions int
+
+	// TombstoneGracePeriod keeps tombstones around for at least this long, even once a compaction could safely drop
+	// them. Gives lagging replicas and migrations time to see a delete before its tombstone is gone, since an older
+	// copy of the key arriving afterwards would otherwise come back to life. 0 drops tombstones as soon as it's safe.
+	TombstoneGracePeriod time.Duration
+
+	// BlockCacheSize is how many bytes of decoded SSTable blocks the store keeps cached, 0 disables the cache
+	BlockCacheSize int64
+}
+
+func DefaultStoreOptions() StoreOptions {
+	return StoreOptions{
+		FlushSizeThreshold:       FlushSizeThreshold,
+		MaxImmutableMemtables:    2,
+		Durability:               GroupCommit,
+		GroupCommitInterval:      2 * time.Millisecond,
+		GroupCommitSize:          1024 * 64,
+		Compression:              NoCompression,
+		FilterPolicy:             DefaultFilterPolicy,
+		Compaction:               SizeTieredCompaction,
+		LevelSizeMultiplier:      DefaultLevelSizeMultiplier,
+		MaxBackgroundCompactions: 2,
+		BlockCacheSize:           8 * 1024 * 1024,
+	}
+}
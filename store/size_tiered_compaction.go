@@ -0,0 +1,157 @@
+package store
+
+import "slices"
+
+// sizeTieredCompaction keeps a bucket of similarly sized runs per level, and merges a bucket once it holds between
+// minTableThreshold and maxTableThreshold runs. A run is either a flushed table or every table one compaction split its
+// output into, which stay together as if they were a single big table.
+type sizeTieredCompaction struct {
+	buckets           map[int]*Bucket // maybe make map?
+	highestLvl        int
+	minTableThreshold int
+	maxTableThreshold int
+	tableSize         uint32 // the merged runs are split into tables of about this many bytes
+}
+
+func newSizeTieredCompaction(flushSizeThreshold uint32, tableSize uint32) *sizeTieredCompaction {
+	if tableSize == 0 {
+		tableSize = flushSizeThreshold
+	}
+	stc := &sizeTieredCompaction{
+		buckets:           make(map[int]*Bucket),
+		highestLvl:        1,
+		minTableThreshold: 4,
+		maxTableThreshold: 12,
+		tableSize:         tableSize,
+	}
+	stc.buckets[1] = InitEmptyBucket()
+
+	return stc
+}
+
+func (stc *sizeTieredCompaction) Name() string {
+	return SizeTieredCompaction.String()
+}
+
+func (stc *sizeTieredCompaction) addTable(table *SSTable) int {
+	return stc.placeRun([]*SSTable{table})
+}
+
+func (stc *sizeTieredCompaction) restoreTable(table *SSTable, level int) {
+	for lvl := stc.highestLvl + 1; lvl <= level; lvl++ {
+		stc.buckets[lvl] = InitEmptyBucket()
+	}
+	stc.highestLvl = max(stc.highestLvl, level)
+	stc.buckets[level].AppendTableToBucket(table)
+}
+
+// pickCompaction merges the lowest bucket that's reached the threshold. Runs flushed into a bucket while it's being
+// compacted are left for the next round, and no more than maxTableThreshold runs are merged at once.
+func (stc *sizeTieredCompaction) pickCompaction(running []*compaction) *compaction {
+	busy := busyTables(running)
+	for lvl := 1; lvl <= stc.highestLvl; lvl++ {
+		c := &compaction{targetFileSize: stc.tableSize}
+		picked := 0
+		for _, run := range stc.buckets[lvl].runs() {
+			// * a run is only ever merged as a whole, so it's busy as soon as any of its tables is
+			if picked == stc.maxTableThreshold || slices.ContainsFunc(run, func(table *SSTable) bool {
+				return busy[table.sstCounter]
+			}) {
+				continue
+			}
+			c.inputs = append(c.inputs, run...)
+			picked++
+		}
+		if picked >= stc.minTableThreshold {
+			return c
+		}
+	}
+	return nil
+}
+
+// finishCompaction drops the merged tables from their bucket and places the merged run wherever its size fits, like a
+// flushed table
+func (stc *sizeTieredCompaction) finishCompaction(c *compaction, outputs []*SSTable) []int {
+	merged := busyTables([]*compaction{c})
+	for _, bkt := range stc.buckets {
+		// * readers may still be holding on to the old tables, so the bucket gets a new slice instead of being
+		// * compacted in place
+		kept := make([]SSTable, 0, len(bkt.tables))
+		for i := range bkt.tables {
+			if !merged[bkt.tables[i].sstCounter] {
+				kept = append(kept, bkt.tables[i])
+			}
+		}
+		if len(kept) < len(bkt.tables) {
+			bkt.tables = kept
+			bkt.calculateAvgBucketSize()
+		}
+	}
+
+	levels := make([]int, len(outputs))
+	if len(outputs) > 0 {
+		level := stc.placeRun(outputs)
+		for i := range levels {
+			levels[i] = level
+		}
+	}
+	return levels
+}
+
+func (stc *sizeTieredCompaction) levels() map[int][]*SSTable {
+	levels := make(map[int][]*SSTable, len(stc.buckets))
+	for lvl, bkt := range stc.buckets {
+		for i := range bkt.tables {
+			levels[lvl] = append(levels[lvl], &bkt.tables[i])
+		}
+	}
+	return levels
+}
+
+// placeRun appends the run's tables to the bucket whose average size the whole run fits, and returns the level they
+// were placed at. Runs smaller than every bucket land in level 1, and runs bigger than every bucket start a new level.
+func (stc *sizeTieredCompaction) placeRun(run []*SSTable) int {
+	var size uint32
+	for _, table := range run {
+		size += table.sizeInBytes
+	}
+
+	for currLvl := stc.highestLvl; currLvl > 0; currLvl-- {
+		bkt := stc.buckets[currLvl]
+		if len(bkt.tables) == 0 && currLvl > 1 {
+			continue
+		}
+
+		switch calculateLevel(bkt, size) {
+		case -1:
+			continue
+		case 0:
+			bkt.appendRun(run)
+			return currLvl
+		default: // 1
+			if currLvl == stc.highestLvl {
+				stc.highestLvl++
+				stc.buckets[stc.highestLvl] = InitEmptyBucket()
+			}
+			// * falls between this bucket and the next one up, so it goes with the bigger tables
+			stc.buckets[currLvl+1].appendRun(run)
+			return currLvl + 1
+		}
+	}
+
+	stc.buckets[1].appendRun(run)
+	return 1
+}
+
+func calculateLevel(bucket *Bucket, size uint32) int {
+	lowerSizeThreshold := uint32(bucket.bucketLow * float32(bucket.avgBucketSize))   // 50% lower than avg size
+	higherSizeThreshold := uint32(bucket.bucketHigh * float32(bucket.avgBucketSize)) // 50% higher than avg size
+
+	if size < lowerSizeThreshold {
+		return -1
+	} else if size > higherSizeThreshold {
+		return 1
+	} else {
+		return 0
+	}
+}
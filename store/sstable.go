@@ -1,290 +1,594 @@
 package store
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
-	"strings"
+	"path/filepath"
+	"sort"
 	"sync/atomic"
+	"time"
 
 	"github.com/tferdous17/genesis/utils"
 )
 
+/*
+Every SSTable is a single file laid out as follows:
+
+| Data | Index | Filter | Properties | Footer |
+
+Data:       the records sorted by key (see kv_format.go), split into blocks of about BlockSize bytes
+Index:      | KeySize | LastKey | Offset | Size | for every block
+Filter:     the bloom filter, packed along with its bit count, hash count, hash scheme and prefix length (see bloom_filter.go)
+Properties: | NumEntries | MinSeqNum | MaxSeqNum | MinKeySize | MinKey | MaxKeySize | MaxKey |
+Footer:     | IndexOffset | FilterOffset | PropertiesOffset | Version | Magic |
+
+Blocks are cut once they reach BlockSize bytes (before compression), and each one is followed by a trailer naming the
+codec it's compressed with and a CRC of the stored block and codec:
+
+| Records (possibly compressed) | Codec | CRC |
+
+An index entry's Size covers the whole block, trailer included.
+
+The data section starts at offset 0 and every section runs up to the start of the next one. The footer has a fixed
+size, so readers start at the end of the file and check the magic number and format version before anything else.
+*/
 const (
-	DataFileExtension  string = ".data"
-	IndexFileExtension string = ".index"
-	BloomFileExtension string = ".bloom"
+	SSTableFileExtension string = ".sst"
 
-	SparseIndexSampleSize int = 1000
-)
+	// BlockSize is the target size of a data block, a block is cut once it reaches this size
+	BlockSize int = 4 * 1024
 
-var sstTableCounter uint32
+	sstableMagic      uint32 = 0x54535347 // "GSST"
+	sstableVersion    uint32 = 7
+	sstableFooterSize        = 20
+	blockTrailerSize         = 5
+)
 
 type SSTable struct {
-	dataFile    *os.File
-	indexFile   *os.File
+	file        *os.File
 	bloomFilter *BloomFilter
 	sstCounter  uint32
+	numEntries  uint32
 	minKey      string
 	maxKey      string
-	sizeInBytes uint32
-	sparseKeys  []sparseIndex
+	sizeInBytes uint32 // size of the data section
+	blocks      []blockHandle
+	minSeqNum   uint64      // lowest sequence number of any record in this table
+	maxSeqNum   uint64      // highest sequence number of any record in this table
+	run         uint32      // sstCounter of the first table its compaction wrote, 0 if it's a run of its own
+	cache       *BlockCache // shared with the rest of the store's tables, nil for none
+	// one reference for the BucketManager while the table is live plus one per reader, the file is closed once the
+	// last one is released. a pointer, so copies of the struct share it
+	refs *atomic.Int32
 }
 
-// InitSSTableOnDisk directory to store sstable, (sorted) entries to store in said table
-func InitSSTableOnDisk(directory string, entries *[]Record) (*SSTable, error) {
-	atomic.AddUint32(&sstTableCounter, 1)
-	table := &SSTable{
-		sstCounter: sstTableCounter,
-	}
-	err := table.InitTableFiles(directory)
+// sstableFooter holds where each section of the table starts
+type sstableFooter struct {
+	indexOffset      uint32
+	filterOffset     uint32
+	propertiesOffset uint32
+	version          uint32
+}
+
+// InitSSTableOnDisk directory to store sstable, table number (allocated by the store's manifest), (sorted) entries to
+// store in said table, codec to compress its data blocks with, policy to build its filter with (nil for the default)
+func InitSSTableOnDisk(directory string, tableNum uint32, entries *[]Record, compression Compression, filterPolicy FilterPolicy) (*SSTable, error) {
+	writer, err := newSSTableWriter(directory, tableNum, uint32(len(*entries)), compression, filterPolicy)
 	if err != nil {
 		return nil, err
 	}
-	err2 := writeEntriesToSST(entries, table)
-	if err2 != nil {
+	for i := range *entries {
+		if err := writer.add(&(*entries)[i]); err != nil {
+			writer.abandon()
+			return nil, err
+		}
+	}
+	table, err := writer.finish()
+	if err != nil {
+		writer.abandon()
 		return nil, err
 	}
 
 	return table, nil
 }
 
-func (sst *SSTable) InitTableFiles(directory string) error {
-	// Create "storage" folder with read-write-execute for owner & group, read-only for others
-	if err := os.MkdirAll("../storage", 0755); err != nil {
-		return err
+// OpenSSTable rebuilds an existing table from its file. path is the table's filename without an extension,
+// e.g. ../storage/node-1/sst_3
+func OpenSSTable(path string) (*SSTable, error) {
+	table := &SSTable{}
+	if _, err := fmt.Sscanf(filepath.Base(path), "sst_%d", &table.sstCounter); err != nil {
+		return nil, fmt.Errorf("invalid sstable path %s: %w", path, err)
 	}
 
-	// create data and index files
-	dataFile, err := os.Create(getNextSstFilename(directory, sst.sstCounter) + DataFileExtension)
+	var err error
+	if table.file, err = os.OpenFile(path+SSTableFileExtension, os.O_RDWR, 0666); err != nil {
+		return nil, err
+	}
+	table.refs = newTableRefs()
+	info, err := table.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < sstableFooterSize {
+		return nil, fmt.Errorf("%w: %s is too small to hold a footer", utils.ErrSSTableCorrupted, table.file.Name())
+	}
 
+	footerBuf := make([]byte, sstableFooterSize)
+	if _, err := table.file.ReadAt(footerBuf, info.Size()-sstableFooterSize); err != nil {
+		return nil, err
+	}
+	footer, err := decodeSSTableFooter(footerBuf)
 	if err != nil {
-		return fmt.Errorf("failed to create data file: %w", err)
+		return nil, fmt.Errorf("%s: %w", table.file.Name(), err)
+	}
+	footerOffset := uint32(info.Size() - sstableFooterSize)
+	if footer.indexOffset > footer.filterOffset || footer.filterOffset > footer.propertiesOffset || footer.propertiesOffset > footerOffset {
+		return nil, fmt.Errorf("%w: %s has out of order section offsets", utils.ErrSSTableCorrupted, table.file.Name())
 	}
 
-	indexFile, err := os.Create(getNextSstFilename(directory, sst.sstCounter) + IndexFileExtension)
+	// * everything after the data section is small, so it's read in one go
+	meta := make([]byte, footerOffset-footer.indexOffset)
+	if _, err := table.file.ReadAt(meta, int64(footer.indexOffset)); err != nil {
+		return nil, err
+	}
+	indexSection := meta[:footer.filterOffset-footer.indexOffset]
+	filterSection := meta[footer.filterOffset-footer.indexOffset : footer.propertiesOffset-footer.indexOffset]
+	propertiesSection := meta[footer.propertiesOffset-footer.indexOffset:]
 
-	if err != nil {
-		err := dataFile.Close()
-		if err != nil {
-			return err
-		} // Clean up previously created files
-		return fmt.Errorf("failed to create index file: %w", err)
+	table.sizeInBytes = footer.indexOffset
+	if table.blocks, err = decodeBlockIndex(indexSection); err != nil {
+		return nil, fmt.Errorf("%w: %s has a malformed index: %w", utils.ErrSSTableCorrupted, table.file.Name(), err)
+	}
+	if len(table.blocks) == 0 {
+		return nil, fmt.Errorf("%w: %s has an empty index", utils.ErrSSTableCorrupted, table.file.Name())
+	}
+	table.bloomFilter = NewBloomFilter()
+	if err := table.bloomFilter.Load(filterSection); err != nil {
+		return nil, fmt.Errorf("%w: %s has a malformed filter: %w", utils.ErrSSTableCorrupted, table.file.Name(), err)
+	}
+	if err := table.decodeProperties(propertiesSection); err != nil {
+		return nil, fmt.Errorf("%w: %s has malformed properties: %w", utils.ErrSSTableCorrupted, table.file.Name(), err)
 	}
 
-	bloomFile, err := os.Create(getNextSstFilename(directory, sst.sstCounter) + BloomFileExtension)
+	return table, nil
+}
 
+// loadSSTable reopens a table the manifest says is live
+func loadSSTable(directory string, meta tableMeta) (*SSTable, error) {
+	table, err := OpenSSTable(getNextSstFilename(directory, meta.tableNum))
 	if err != nil {
-		err := dataFile.Close()
-		if err != nil {
-			return err
-		} // Clean up previously created files
-		err2 := indexFile.Close()
-		if err2 != nil {
-			return err2
-		}
-		return fmt.Errorf("failed to create bloom filter file: %w", err)
+		return nil, err
+	}
+	if table.sizeInBytes != meta.sizeInBytes || table.minKey != meta.minKey || table.maxKey != meta.maxKey || table.maxSeqNum != meta.maxSeqNum {
+		return nil, fmt.Errorf("%w: table %d doesn't match its manifest entry", utils.ErrManifestCorrupted, meta.tableNum)
 	}
+	table.run = meta.run
+	return table, nil
+}
 
-	sst.dataFile, sst.indexFile = dataFile, indexFile
-	sst.bloomFilter = NewBloomFilter(bloomFile)
+// readBlock returns the records of the i-th data block, from the block cache if possible. The records are shared
+// with the cache and must not be modified.
+func (sst *SSTable) readBlock(i int) ([]Record, error) {
+	if sst.cache == nil {
+		return sst.readBlockFromDisk(i)
+	}
 
-	return nil
+	key := blockCacheKey{tableNum: sst.sstCounter, offset: sst.blocks[i].offset}
+	if records, found := sst.cache.get(key); found {
+		return records, nil
+	}
+	records, err := sst.readBlockFromDisk(i)
+	if err != nil {
+		return nil, err
+	}
+	sst.cache.put(key, records)
+	return records, nil
 }
 
-func getNextSstFilename(directory string, sstCounter uint32) string {
-	return fmt.Sprintf("../%s/sst_%d", directory, sstCounter)
+// readBlockFromDisk reads the i-th data block with a single read, verifies its CRC and decodes its records
+func (sst *SSTable) readBlockFromDisk(i int) ([]Record, error) {
+	handle := sst.blocks[i]
+	data := make([]byte, handle.size)
+	if _, err := sst.file.ReadAt(data, int64(handle.offset)); err != nil {
+		return nil, err
+	}
+
+	records, err := decodeBlock(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s block %d at offset %d: %w", utils.ErrSSTableCorrupted, sst.file.Name(), i, handle.offset, err)
+	}
+	return records, nil
 }
 
-type sparseIndex struct {
-	keySize    uint32
-	key        string
-	byteOffset uint32 // where to start reading from
+// findBlock returns the index of the first block whose last key is >= key, which is the only block that can hold
+// key. Returns len(sst.blocks) if key is past the end of the table.
+func (sst *SSTable) findBlock(key string) int {
+	return sort.Search(len(sst.blocks), func(i int) bool { return sst.blocks[i].lastKey >= key })
 }
 
-func writeEntriesToSST(sortedEntries *[]Record, table *SSTable) error {
-	buf := new(bytes.Buffer)
-	var byteOffsetCounter uint32
+// decodeBlock checks the trailer of a block, then decompresses and decodes the records before it
+func decodeBlock(data []byte) ([]Record, error) {
+	if len(data) < blockTrailerSize {
+		return nil, fmt.Errorf("block is too small to hold a trailer")
+	}
+	crcOffset := len(data) - 4
+	if crc32.ChecksumIEEE(data[:crcOffset]) != binary.LittleEndian.Uint32(data[crcOffset:]) {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
 
-	// Keep track of min, max for searching in the case our desired key is outside these bounds
-	table.minKey = (*sortedEntries)[0].Key
-	table.maxKey = (*sortedEntries)[len(*sortedEntries)-1].Key
-
-	// * every 1000th key will be put into the sparse index
-	for i := range *sortedEntries {
-		table.sizeInBytes += (*sortedEntries)[i].RecordSize
-		if i%SparseIndexSampleSize == 0 {
-			table.sparseKeys = append(table.sparseKeys, sparseIndex{
-				keySize:    (*sortedEntries)[i].Header.KeySize,
-				key:        (*sortedEntries)[i].Key,
-				byteOffset: byteOffsetCounter,
-			})
+	codec := Compression(data[crcOffset-1])
+	payload, err := decompressBlock(codec, data[:crcOffset-1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s block: %w", codec, err)
+	}
+	return decodeRecords(payload)
+}
+
+// decodeRecords decodes back to back records, data must end on a record boundary
+func decodeRecords(data []byte) ([]Record, error) {
+	var records []Record
+	for offset := uint32(0); offset < uint32(len(data)); {
+		if offset+headerSize > uint32(len(data)) {
+			return nil, utils.ErrDecodingHeaderFailed
 		}
-		byteOffsetCounter += (*sortedEntries)[i].RecordSize
-		err := (*sortedEntries)[i].EncodeKV(buf)
+		h, err := NewHeader(data[offset : offset+headerSize])
 		if err != nil {
-			return err
+			return nil, err
 		}
+		recordSize := headerSize + h.KeySize + h.ValueSize
+		if offset+recordSize > uint32(len(data)) {
+			return nil, utils.ErrDecodingKVFailed
+		}
+
+		r := Record{}
+		if err := r.DecodeKV(data[offset : offset+recordSize]); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+		offset += recordSize
 	}
 
-	// after encoding all entries, dump into the SSTable
-	if err := utils.WriteToFile(buf.Bytes(), table.dataFile); err != nil {
-		fmt.Println("write to sst err:", err)
+	return records, nil
+}
+
+func (sst *SSTable) InitTableFiles(directory string) error {
+	// Create storage folder with read-write-execute for owner & group, read-only for others
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
 	}
-	// * Set up sparse index
-	utils.Logf("SPARSE KEYS: %v", table.sparseKeys)
-	err := populateSparseIndexFile(&table.sparseKeys, table.indexFile)
+
+	file, err := os.Create(getNextSstFilename(directory, sst.sstCounter) + SSTableFileExtension)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to create sstable file: %w", err)
 	}
 
-	// * Set up + populate bloom filter
-	table.bloomFilter.InitBloomFilterAttrs(uint32(len(*sortedEntries)))
-	populateBloomFilter(sortedEntries, table.bloomFilter)
+	sst.file = file
+	sst.refs = newTableRefs()
 
 	return nil
 }
 
-func populateSparseIndexFile(indices *[]sparseIndex, indexFile *os.File) error {
-	// encode and write to index file
-	buf := new(bytes.Buffer)
-	for i := range *indices {
-		err := binary.Write(buf, binary.LittleEndian, (*indices)[i].keySize)
-		if err != nil {
-			return err
+func newTableRefs() *atomic.Int32 {
+	refs := new(atomic.Int32)
+	refs.Store(1)
+	return refs
+}
+
+// ref keeps the table's file open until the matching unref. It fails once the last reference is gone, since the file
+// is already closed by then
+func (sst *SSTable) ref() bool {
+	for {
+		refs := sst.refs.Load()
+		if refs <= 0 {
+			return false
 		}
-		buf.WriteString((*indices)[i].key)
-		err2 := binary.Write(buf, binary.LittleEndian, (*indices)[i].byteOffset)
-		if err2 != nil {
-			return err2
+		if sst.refs.CompareAndSwap(refs, refs+1) {
+			return true
 		}
 	}
+}
 
-	if err := utils.WriteToFile(buf.Bytes(), indexFile); err != nil {
-		fmt.Println("write to indexfile err:", err)
+// unref releases a reference to the table, closing its file once the last one is gone
+func (sst *SSTable) unref() {
+	if sst.refs.Add(-1) == 0 {
+		_ = sst.file.Close()
 	}
-	return nil
+}
 
+func getNextSstFilename(directory string, sstCounter uint32) string {
+	return filepath.Join(directory, fmt.Sprintf("sst_%d", sstCounter))
 }
 
-func populateBloomFilter(entries *[]Record, bloomFilter *BloomFilter) {
-	for i := range *entries {
-		err := bloomFilter.Add((*entries)[i].Key)
-		if err != nil {
-			return
-		}
-	}
+// blockHandle locates a data block, and is what the index stores for every block
+type blockHandle struct {
+	lastKey string // every key in the block is <= lastKey
+	offset  uint32
+	size    uint32 // including the trailing CRC
+}
 
-	bfBytes := make([]byte, bloomFilter.bitSetSize)
-	for i, b := range bloomFilter.bitSet {
-		if b {
-			bfBytes[i] = 1
-		} else {
-			bfBytes[i] = 0
-		}
+// sstableWriter writes a table one record at a time, streaming every data block to disk as soon as it's cut. Only the
+// block being filled, the index and the filter (a few bits per key, every key is added as it comes in) stay in memory
+// until the table is finished.
+type sstableWriter struct {
+	table        *SSTable
+	out          *bufio.Writer
+	block        bytes.Buffer
+	blockLastKey string
+	compressor   *blockCompressor
+	offset       uint32 // bytes of data written so far
+}
+
+// newSSTableWriter starts a table whose filter is sized for expectedKeys keys. Writing more keys than that still works,
+// the filter just ends up with a higher false positive rate.
+func newSSTableWriter(directory string, tableNum uint32, expectedKeys uint32, compression Compression, filterPolicy FilterPolicy) (*sstableWriter, error) {
+	table := &SSTable{sstCounter: tableNum}
+	if err := table.InitTableFiles(directory); err != nil {
+		return nil, err
 	}
-	if err := utils.WriteToFile(bfBytes, bloomFilter.file); err != nil {
-		fmt.Println("write to bloomfile err:", err)
+	if filterPolicy == nil {
+		filterPolicy = DefaultFilterPolicy
 	}
+	table.bloomFilter = filterPolicy.NewFilter(expectedKeys)
+	return &sstableWriter{
+		table:      table,
+		out:        bufio.NewWriter(table.file),
+		compressor: newBlockCompressor(compression),
+	}, nil
 }
 
-func (sst *SSTable) Get(key string) (string, error) {
-	if key < sst.minKey || key > sst.maxKey {
-		return "<!>", utils.ErrKeyNotWithinTable
+// add appends the record to the table, records have to be added in sorted order
+func (w *sstableWriter) add(record *Record) error {
+	// Keep track of min, max for searching in the case our desired key is outside these bounds
+	if w.table.numEntries == 0 {
+		w.table.minKey = record.Key
+		w.table.minSeqNum = record.Header.SeqNum
+	}
+	w.table.maxKey = record.Key
+	w.table.numEntries++
+	w.table.minSeqNum = min(w.table.minSeqNum, record.Header.SeqNum)
+	w.table.maxSeqNum = max(w.table.maxSeqNum, record.Header.SeqNum)
+	if err := w.table.bloomFilter.Add(record.Key); err != nil {
+		return err
 	}
 
-	if !sst.bloomFilter.MightContain(key) {
-		utils.LogRED("BLOOM FILTER: %s is not a member of this table", key)
-		return "", utils.ErrKeyNotWithinTable
+	if err := record.EncodeKV(&w.block); err != nil {
+		return err
 	}
+	w.blockLastKey = record.Key
 
-	// * Get sparse index and move to offset
-	currOffset := sst.sparseKeys[sst.getCandidateByteOffsetIndex(key)].byteOffset
-	if _, err := sst.dataFile.Seek(int64(currOffset), 0); err != nil {
-		return "", err
+	// * cut the block once it's big enough
+	if w.block.Len() >= BlockSize {
+		return w.flushBlock()
 	}
-	// * start loop
-	var keyFound = false
-	var eofErr error
+	return nil
+}
 
-	for !keyFound || eofErr == nil {
-		// * set up entry for the header
-		currEntry := make([]byte, 17)
-		_, err := io.ReadFull(sst.dataFile, currEntry)
-		if errors.Is(err, io.EOF) {
-			//eofErr = err
-			return "", err
+// size is how many bytes of data have been added so far, counting the block being filled before compression
+func (w *sstableWriter) size() uint32 {
+	return w.offset + uint32(w.block.Len())
+}
+
+// flushBlock seals the block being filled with its trailer, writes it out and indexes its last key
+func (w *sstableWriter) flushBlock() error {
+	codec, stored, err := w.compressor.compress(w.block.Bytes())
+	if err != nil {
+		return err
+	}
+	trailer := make([]byte, blockTrailerSize)
+	trailer[0] = byte(codec)
+	binary.LittleEndian.PutUint32(trailer[1:], crc32.Update(crc32.ChecksumIEEE(stored), crc32.IEEETable, trailer[:1]))
+	if _, err := w.out.Write(stored); err != nil {
+		return err
+	}
+	if _, err := w.out.Write(trailer); err != nil {
+		return err
+	}
+
+	size := uint32(len(stored) + blockTrailerSize)
+	w.table.blocks = append(w.table.blocks, blockHandle{lastKey: w.blockLastKey, offset: w.offset, size: size})
+	w.offset += size
+	w.block.Reset()
+	return nil
+}
+
+// finish writes the last block and every section after the data, and syncs the table to disk
+func (w *sstableWriter) finish() (*SSTable, error) {
+	if w.block.Len() > 0 {
+		if err := w.flushBlock(); err != nil {
+			return nil, err
 		}
+	}
+	table := w.table
+	table.sizeInBytes = w.offset
+
+	// * Set up block index
+	buf := new(bytes.Buffer)
+	footer := sstableFooter{indexOffset: w.offset, version: sstableVersion}
+	if err := encodeBlockIndex(table.blocks, buf); err != nil {
+		return nil, err
+	}
 
-		h := &Header{}
-		err2 := h.DecodeHeader(currEntry)
-		if err2 != nil {
-			return "", err2
+	// * the bloom filter was populated as the records came in
+	footer.filterOffset = w.offset + uint32(buf.Len())
+	buf.Write(table.bloomFilter.Encode())
+
+	footer.propertiesOffset = w.offset + uint32(buf.Len())
+	table.encodeProperties(buf)
+	footer.encode(buf)
+
+	if _, err := w.out.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := w.out.Flush(); err != nil {
+		return nil, err
+	}
+	// VERY important to call Sync, otherwise the table may not have reached disk by the time the manifest says it's live
+	return table, table.file.Sync()
+}
+
+// abandon deletes the partly written table
+func (w *sstableWriter) abandon() {
+	_ = w.table.file.Close()
+	_ = os.Remove(w.table.file.Name())
+}
+
+func encodeBlockIndex(blocks []blockHandle, buf *bytes.Buffer) error {
+	for i := range blocks {
+		if err := binary.Write(buf, binary.LittleEndian, uint32(len(blocks[i].lastKey))); err != nil {
+			return err
 		}
+		buf.WriteString(blocks[i].lastKey)
+		if err := binary.Write(buf, binary.LittleEndian, blocks[i].offset); err != nil {
+			return err
+		}
+		if err := binary.Write(buf, binary.LittleEndian, blocks[i].size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		// * move the cursor so we can read the rest of the record
-		currOffset += headerSize // can do this since headerSize is constant
-		_, err3 := sst.dataFile.Seek(int64(currOffset), 0)
-		if err3 != nil {
-			return "", err3
+// decodeBlockIndex decodes the | KeySize | LastKey | Offset | Size | entries written by encodeBlockIndex
+func decodeBlockIndex(data []byte) ([]blockHandle, error) {
+	var blocks []blockHandle
+	for offset := 0; offset < len(data); {
+		if offset+4 > len(data) {
+			return nil, utils.ErrDecodingKVFailed
 		}
-		// * set up []byte for the rest of the record
-		currRecord := make([]byte, h.KeySize+h.ValueSize)
-		if _, err2 := io.ReadFull(sst.dataFile, currRecord); err2 != nil {
-			fmt.Println("READFULL ERR:", err2)
-			return "", err2
+		keySize := int(binary.LittleEndian.Uint32(data[offset:]))
+		offset += 4
+		if offset+keySize+8 > len(data) {
+			return nil, utils.ErrDecodingKVFailed
 		}
-		// * append both []byte together in order to decode as a whole
-		currEntry = append(currEntry, currRecord...) // full size of the record
-		r := &Record{}
-		err4 := r.DecodeKV(currEntry)
-		if err4 != nil {
-			return "", err4
+		handle := blockHandle{lastKey: string(data[offset : offset+keySize])}
+		offset += keySize
+		handle.offset = binary.LittleEndian.Uint32(data[offset:])
+		handle.size = binary.LittleEndian.Uint32(data[offset+4:])
+		offset += 8
+
+		blocks = append(blocks, handle)
+	}
+
+	return blocks, nil
+}
+
+func (sst *SSTable) encodeProperties(buf *bytes.Buffer) {
+	_ = binary.Write(buf, binary.LittleEndian, sst.numEntries)
+	_ = binary.Write(buf, binary.LittleEndian, sst.minSeqNum)
+	_ = binary.Write(buf, binary.LittleEndian, sst.maxSeqNum)
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(sst.minKey)))
+	buf.WriteString(sst.minKey)
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(sst.maxKey)))
+	buf.WriteString(sst.maxKey)
+}
+
+func (sst *SSTable) decodeProperties(data []byte) error {
+	reader := bytes.NewReader(data)
+	readString := func() (string, error) {
+		var size uint32
+		if err := binary.Read(reader, binary.LittleEndian, &size); err != nil {
+			return "", err
 		}
-		//utils.Logf("LOOKING AT RECORD: %v", r)
-
-		if r.Key == key {
-			utils.LogGREEN("FOUND KEY %s -> VALUE %s\n", key, r.Value)
-			//keyFound = true
-			return r.Value, nil
-		} else if r.Key > key {
-			// * return early
-			// * this works b/c since our data is sorted, if the curr key is > target key,
-			// * ..then the key is not in this table
-			return "", utils.ErrKeyNotWithinTable
-		} else {
-			// * else, need to keep iterating & looking
-			currOffset += r.Header.KeySize + r.Header.ValueSize
-			_, err2 := sst.dataFile.Seek(int64(currOffset), 0)
-			if err2 != nil {
-				return "", err2
-			}
+		if int(size) > reader.Len() {
+			return "", io.ErrUnexpectedEOF
 		}
+		b := make([]byte, size)
+		_, _ = reader.Read(b)
+		return string(b), nil
+	}
 
+	var err error
+	if err = binary.Read(reader, binary.LittleEndian, &sst.numEntries); err != nil {
+		return err
 	}
+	if err = binary.Read(reader, binary.LittleEndian, &sst.minSeqNum); err != nil {
+		return err
+	}
+	if err = binary.Read(reader, binary.LittleEndian, &sst.maxSeqNum); err != nil {
+		return err
+	}
+	if sst.minKey, err = readString(); err != nil {
+		return err
+	}
+	if sst.maxKey, err = readString(); err != nil {
+		return err
+	}
+	if reader.Len() != 0 {
+		return fmt.Errorf("%d trailing bytes", reader.Len())
+	}
+	return nil
+}
 
-	return "", utils.ErrKeyNotFound
+func (f *sstableFooter) encode(buf *bytes.Buffer) {
+	_ = binary.Write(buf, binary.LittleEndian, f.indexOffset)
+	_ = binary.Write(buf, binary.LittleEndian, f.filterOffset)
+	_ = binary.Write(buf, binary.LittleEndian, f.propertiesOffset)
+	_ = binary.Write(buf, binary.LittleEndian, f.version)
+	_ = binary.Write(buf, binary.LittleEndian, sstableMagic)
 }
 
-func (sst *SSTable) getCandidateByteOffsetIndex(targetKey string) int {
-	low := 0
-	high := len(sst.sparseKeys) - 1
+// decodeSSTableFooter checks the magic number and version before trusting any of the offsets
+func decodeSSTableFooter(buf []byte) (*sstableFooter, error) {
+	if magic := binary.LittleEndian.Uint32(buf[16:20]); magic != sstableMagic {
+		return nil, fmt.Errorf("%w: bad magic number %#x", utils.ErrSSTableCorrupted, magic)
+	}
+	footer := &sstableFooter{
+		indexOffset:      binary.LittleEndian.Uint32(buf[0:4]),
+		filterOffset:     binary.LittleEndian.Uint32(buf[4:8]),
+		propertiesOffset: binary.LittleEndian.Uint32(buf[8:12]),
+		version:          binary.LittleEndian.Uint32(buf[12:16]),
+	}
+	if footer.version != sstableVersion {
+		return nil, fmt.Errorf("%w: format version %d, this build only reads version %d",
+			utils.ErrUnsupportedSSTableVersion, footer.version, sstableVersion)
+	}
+	return footer, nil
+}
 
-	for low <= high {
-		mid := (low + high) / 2
+// Get returns the value of key in this table. A tombstoned or expired key counts as deleted and returns
+// utils.ErrKeyNotFound, while a key that isn't in the table at all returns utils.ErrKeyNotWithinTable.
+func (sst *SSTable) Get(key string) (string, error) {
+	record, err := sst.getRecord(key)
+	if err != nil {
+		return "", err
+	}
+	if record.Header.deleted(uint32(time.Now().Unix())) {
+		return "", utils.ErrKeyNotFound
+	}
+	return record.Value, nil
+}
 
-		cmp := strings.Compare(targetKey, sst.sparseKeys[mid].key)
-		if cmp > 0 { // targetKey > sparseKeys[mid]
-			low = mid + 1
-		} else if cmp < 0 { // targetKey < sparseKeys[mid]
-			high = mid - 1
-		} else { // equal
-			return mid
-		}
+// getRecord returns the full record (tombstones included) for key, or utils.ErrKeyNotWithinTable if this table
+// doesn't have it
+func (sst *SSTable) getRecord(key string) (*Record, error) {
+	if key < sst.minKey || key > sst.maxKey {
+		return nil, utils.ErrKeyNotWithinTable
+	}
+
+	if !sst.bloomFilter.MightContain(key) {
+		utils.LogRED("BLOOM FILTER: %s is not a member of this table", key)
+		return nil, utils.ErrKeyNotWithinTable
+	}
+
+	// * binary search the index for the one block that could hold the key, then binary search inside the block
+	i := sst.findBlock(key)
+	if i == len(sst.blocks) {
+		return nil, utils.ErrKeyNotWithinTable
+	}
+	records, err := sst.readBlock(i)
+	if err != nil {
+		return nil, err
+	}
+
+	j := sort.Search(len(records), func(j int) bool { return records[j].Key >= key })
+	if j < len(records) && records[j].Key == key {
+		utils.LogGREEN("FOUND KEY %s -> VALUE %s\n", key, records[j].Value)
+		return &records[j], nil
 	}
-	utils.LogCYAN("CANDIDATE BYTE OFFSET: %d AT INDEX %d", sst.sparseKeys[low-1].byteOffset, uint32(low-1))
-	return low - 1
+	return nil, utils.ErrKeyNotWithinTable
 }
@@ -0,0 +1,194 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tferdous17/genesis/utils"
+)
+
+func TestOpenSSTable(t *testing.T) {
+	dir := t.TempDir()
+
+	var entries []Record
+	for i := 0; i < 2500; i++ {
+		key, val := fmt.Sprintf("user%05d", i), fmt.Sprintf("hero%d", i)
+		entries = append(entries, Record{
+			Header:     Header{SeqNum: uint64(i + 1), KeySize: uint32(len(key)), ValueSize: uint32(len(val))},
+			Key:        key,
+			Value:      val,
+			RecordSize: headerSize + uint32(len(key)+len(val)),
+		})
+	}
+	written, err := InitSSTableOnDisk(dir, 7, &entries, NoCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := OpenSSTable(getNextSstFilename(dir, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.sstCounter != 7 || opened.minKey != written.minKey || opened.maxKey != written.maxKey || opened.sizeInBytes != written.sizeInBytes {
+		t.Fatalf("expected table 7 [%s, %s] of %d bytes, got table %d [%s, %s] of %d bytes",
+			written.minKey, written.maxKey, written.sizeInBytes, opened.sstCounter, opened.minKey, opened.maxKey, opened.sizeInBytes)
+	}
+	if opened.maxSeqNum != 2500 || opened.numEntries != 2500 {
+		t.Fatalf("expected 2500 entries with max sequence number 2500, got %d entries with %d", opened.numEntries, opened.maxSeqNum)
+	}
+	if len(opened.blocks) < 2 || len(opened.blocks) != len(written.blocks) || opened.blocks[1] != written.blocks[1] {
+		t.Fatalf("expected block index %v, got %v", written.blocks, opened.blocks)
+	}
+	if opened.bloomFilter.bitSetSize != written.bloomFilter.bitSetSize || opened.bloomFilter.hashCount != written.bloomFilter.hashCount {
+		t.Fatalf("expected bloom filter with %d bits and %d hashes, got %d bits and %d hashes",
+			written.bloomFilter.bitSetSize, written.bloomFilter.hashCount, opened.bloomFilter.bitSetSize, opened.bloomFilter.hashCount)
+	}
+
+	for _, i := range []int{0, 999, 1000, 1500, 2499} {
+		val, err := opened.Get(fmt.Sprintf("user%05d", i))
+		if err != nil || val != fmt.Sprintf("hero%d", i) {
+			t.Fatalf("expected user%05d = hero%d, got %q (err = %v)", i, i, val, err)
+		}
+	}
+}
+
+func TestOpenSSTable_RejectsUnknownFormat(t *testing.T) {
+	dir := t.TempDir()
+	key, val := "user1", "batman"
+	entries := []Record{{
+		Header:     Header{KeySize: uint32(len(key)), ValueSize: uint32(len(val))},
+		Key:        key,
+		Value:      val,
+		RecordSize: headerSize + uint32(len(key)+len(val)),
+	}}
+	if _, err := InitSSTableOnDisk(dir, 1, &entries, NoCompression, nil); err != nil {
+		t.Fatal(err)
+	}
+	path := getNextSstFilename(dir, 1) + SSTableFileExtension
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// * the version sits just before the magic number at the very end of the file
+	newerVersion := append([]byte{}, data...)
+	binary.LittleEndian.PutUint32(newerVersion[len(newerVersion)-8:], sstableVersion+1)
+	if err := os.WriteFile(path, newerVersion, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSSTable(getNextSstFilename(dir, 1)); !errors.Is(err, utils.ErrUnsupportedSSTableVersion) {
+		t.Fatalf("expected ErrUnsupportedSSTableVersion, got %v", err)
+	}
+
+	badMagic := append([]byte{}, data...)
+	badMagic[len(badMagic)-1] ^= 0xFF
+	if err := os.WriteFile(path, badMagic, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSSTable(getNextSstFilename(dir, 1)); !errors.Is(err, utils.ErrSSTableCorrupted) {
+		t.Fatalf("expected ErrSSTableCorrupted, got %v", err)
+	}
+}
+
+func TestSSTable_CorruptBlock(t *testing.T) {
+	dir := t.TempDir()
+
+	var entries []Record
+	for i := 0; i < 500; i++ {
+		key, val := fmt.Sprintf("user%05d", i), fmt.Sprintf("hero%d", i)
+		entries = append(entries, Record{
+			Header:     Header{KeySize: uint32(len(key)), ValueSize: uint32(len(val))},
+			Key:        key,
+			Value:      val,
+			RecordSize: headerSize + uint32(len(key)+len(val)),
+		})
+	}
+	table, err := InitSSTableOnDisk(dir, 1, &entries, NoCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table.blocks) < 3 {
+		t.Fatalf("expected several blocks, got %d", len(table.blocks))
+	}
+
+	// * flip a byte in the middle of the second block
+	corrupted := table.blocks[1]
+	if _, err := table.file.WriteAt([]byte{0xFF}, int64(corrupted.offset+corrupted.size/2)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = table.Get(corrupted.lastKey)
+	if !errors.Is(err, utils.ErrSSTableCorrupted) || !strings.Contains(err.Error(), fmt.Sprintf("block 1 at offset %d", corrupted.offset)) {
+		t.Fatalf("expected ErrSSTableCorrupted naming block 1 at offset %d, got %v", corrupted.offset, err)
+	}
+	// * every other block is still readable
+	if val, err := table.Get(table.blocks[0].lastKey); err != nil || val == "" {
+		t.Fatalf("expected the first block to be unaffected, got %q (err = %v)", val, err)
+	}
+}
+
+func TestSSTable_Compression(t *testing.T) {
+	dir := t.TempDir()
+
+	// * verbose JSON values compress well, except for a stretch of random ones in the middle that don't at all
+	rng := rand.New(rand.NewSource(1))
+	var entries []Record
+	for i := 0; i < 600; i++ {
+		key := fmt.Sprintf("user%05d", i)
+		val := fmt.Sprintf(`{"name": "hero%d", "team": "justice league", "powers": ["flight", "strength"]}`, i)
+		if i >= 200 && i < 203 {
+			raw := make([]byte, 2*BlockSize)
+			rng.Read(raw)
+			val = string(raw)
+		}
+		entries = append(entries, Record{
+			Header:     Header{KeySize: uint32(len(key)), ValueSize: uint32(len(val))},
+			Key:        key,
+			Value:      val,
+			RecordSize: headerSize + uint32(len(key)+len(val)),
+		})
+	}
+
+	uncompressed, err := InitSSTableOnDisk(dir, 1, &entries, NoCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, codec := range []Compression{FlateCompression, ZlibCompression} {
+		tableNum := uint32(i + 2)
+		written, err := InitSSTableOnDisk(dir, tableNum, &entries, codec, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if written.sizeInBytes >= uncompressed.sizeInBytes/2 {
+			t.Fatalf("%s: expected data to shrink well below %d bytes, got %d", codec, uncompressed.sizeInBytes, written.sizeInBytes)
+		}
+
+		// * the random stretch is stored as is, so the file mixes codecs
+		codecs := make(map[Compression]bool)
+		for _, block := range written.blocks {
+			trailer := make([]byte, 1)
+			if _, err := written.file.ReadAt(trailer, int64(block.offset+block.size-blockTrailerSize)); err != nil {
+				t.Fatal(err)
+			}
+			codecs[Compression(trailer[0])] = true
+		}
+		if !codecs[codec] || !codecs[NoCompression] {
+			t.Fatalf("%s: expected both compressed and uncompressed blocks, got %v", codec, codecs)
+		}
+
+		opened, err := OpenSSTable(getNextSstFilename(dir, tableNum))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, j := range []int{0, 201, 599} {
+			if val, err := opened.Get(entries[j].Key); err != nil || val != entries[j].Value {
+				t.Fatalf("%s: expected %s = %q, got %q (err = %v)", codec, entries[j].Key, entries[j].Value, val, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/tferdous17/genesis/utils"
+)
+
+// Transaction is an optimistic read-modify-write over several keys of a single store, started by DiskStore.Begin.
+// Reads come from the snapshot of the store taken by Begin (plus the transaction's own writes), while writes are
+// buffered until Commit, which applies them atomically as a single WriteBatch.
+//
+// While a transaction is open, the store holds on to every version a write replaces that its snapshot could still
+// read, so reads keep seeing the snapshot however much the key is written (or compacted) in the meantime. Every
+// transaction has to end with Commit or Rollback to let go of those versions. A Transaction isn't safe for concurrent
+// use.
+//
+//	tx, err := ds.Begin()
+//	balance, err := tx.Get("alice")
+//	...
+//	tx.Put("alice", newBalance)
+//	err = tx.Commit() // utils.ErrTransactionConflict if another write got in first
+type Transaction struct {
+	ds          *DiskStore
+	snapshotSeq uint64 // every write made after Begin has a higher sequence number
+	reads       map[string]bool
+	writes      *WriteBatch
+	pending     map[string]batchEntry // the newest buffered write of every key, so the transaction reads its own writes
+	done        bool
+}
+
+// snapshotTracker keeps track of the snapshots of open transactions, along with every version of a key that was
+// replaced since the oldest of them was taken. Guarded by the store's mu.
+type snapshotTracker struct {
+	open     map[uint64]int               // snapshot sequence number -> transactions reading from it
+	replaced map[string][]replacedVersion // oldest first
+}
+
+// replacedVersion is a version of a key as it was right before the write with sequence number replacedAt
+type replacedVersion struct {
+	record     *Record // nil if the key didn't exist
+	replacedAt uint64
+}
+
+// Begin starts a transaction reading from a snapshot of the store as of now
+func (ds *DiskStore) Begin() (*Transaction, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.closed {
+		return nil, utils.ErrStoreClosed
+	}
+
+	if ds.snapshots.open == nil {
+		ds.snapshots.open = make(map[uint64]int)
+		ds.snapshots.replaced = make(map[string][]replacedVersion)
+	}
+	ds.snapshots.open[ds.seqNum]++
+	return &Transaction{
+		ds:          ds,
+		snapshotSeq: ds.seqNum,
+		reads:       make(map[string]bool),
+		writes:      NewWriteBatch(),
+		pending:     make(map[string]batchEntry),
+	}, nil
+}
+
+// preserveReplacedVersion is called with every write to key before it's applied, and holds on to the version it
+// replaces if an open snapshot might need it. Requires mu
+func (ds *DiskStore) preserveReplacedVersion(key string, seqNum uint64) error {
+	if len(ds.snapshots.open) == 0 {
+		return nil
+	}
+	// * once a version replaced after the newest snapshot is kept, every open snapshot already has the version it
+	// * reads (and knows the key was written since), so there's nothing more to keep
+	versions := ds.snapshots.replaced[key]
+	if len(versions) > 0 && versions[len(versions)-1].replacedAt > ds.snapshots.newest() {
+		return nil
+	}
+	record, err := ds.newestRecord(key)
+	if err != nil {
+		return err
+	}
+	ds.snapshots.replaced[key] = append(versions, replacedVersion{record: record, replacedAt: seqNum})
+	return nil
+}
+
+// snapshotRecord returns the version of key (tombstones included) as of the snapshot, or nil if it didn't exist.
+// Requires mu
+func (ds *DiskStore) snapshotRecord(key string, snapshotSeq uint64) (*Record, error) {
+	// * the first version replaced after the snapshot is the one the snapshot saw
+	for _, version := range ds.snapshots.replaced[key] {
+		if version.replacedAt > snapshotSeq {
+			return version.record, nil
+		}
+	}
+	return ds.newestRecord(key)
+}
+
+// writtenSince reports whether key was written after the snapshot was taken. Requires mu
+func (ds *DiskStore) writtenSince(key string, snapshotSeq uint64) bool {
+	versions := ds.snapshots.replaced[key]
+	return len(versions) > 0 && versions[len(versions)-1].replacedAt > snapshotSeq
+}
+
+// release drops a transaction's snapshot, along with every replaced version no open snapshot can read anymore.
+// Requires mu
+func (st *snapshotTracker) release(snapshotSeq uint64) {
+	if st.open[snapshotSeq]--; st.open[snapshotSeq] == 0 {
+		delete(st.open, snapshotSeq)
+	}
+	if len(st.open) == 0 {
+		clear(st.replaced)
+		return
+	}
+
+	// * a version replaced by the oldest snapshot or before it is older than anything an open snapshot reads
+	oldest := st.oldest()
+	for key, versions := range st.replaced {
+		i := 0
+		for i < len(versions) && versions[i].replacedAt <= oldest {
+			i++
+		}
+		if i == len(versions) {
+			delete(st.replaced, key)
+		} else if i > 0 {
+			st.replaced[key] = slices.Clone(versions[i:])
+		}
+	}
+}
+
+func (st *snapshotTracker) oldest() uint64 {
+	oldest := uint64(math.MaxUint64)
+	for snapshotSeq := range st.open {
+		oldest = min(oldest, snapshotSeq)
+	}
+	return oldest
+}
+
+func (st *snapshotTracker) newest() uint64 {
+	var newest uint64
+	for snapshotSeq := range st.open {
+		newest = max(newest, snapshotSeq)
+	}
+	return newest
+}
+
+// Get returns the value key had in the snapshot, or the value the transaction itself wrote to it since
+func (tx *Transaction) Get(key string) (string, error) {
+	if tx.done {
+		return "", utils.ErrTransactionDone
+	}
+	if entry, ok := tx.pending[key]; ok {
+		if entry.op == DELETE {
+			return "", utils.ErrKeyNotFound
+		}
+		return entry.value, nil
+	}
+
+	tx.ds.mu.Lock()
+	if tx.ds.closed {
+		tx.ds.mu.Unlock()
+		return "", utils.ErrStoreClosed
+	}
+	record, err := tx.ds.snapshotRecord(key, tx.snapshotSeq)
+	tx.ds.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	tx.reads[key] = true
+
+	if record == nil || record.Header.deleted(uint32(time.Now().Unix())) {
+		return "", utils.ErrKeyNotFound
+	}
+	return record.Value, nil
+}
+
+// Put buffers a write of key, value until the transaction commits
+func (tx *Transaction) Put(key string, value string) error {
+	if tx.done {
+		return utils.ErrTransactionDone
+	}
+	if err := utils.ValidateKV(&key, &value); err != nil {
+		return err
+	}
+	tx.writes.Put(key, value)
+	tx.pending[key] = batchEntry{op: PUT, key: key, value: value}
+	return nil
+}
+
+// Delete buffers a delete of key until the transaction commits
+func (tx *Transaction) Delete(key string) error {
+	if tx.done {
+		return utils.ErrTransactionDone
+	}
+	if key == "" {
+		return utils.ErrEmptyKey
+	}
+	tx.writes.Delete(key)
+	tx.pending[key] = batchEntry{op: DELETE, key: key}
+	return nil
+}
+
+// Commit atomically applies every buffered write, unless one of the keys the transaction read or wrote was written
+// by someone else since the snapshot, in which case nothing is applied and utils.ErrTransactionConflict is returned.
+// Either way, the transaction is over.
+func (tx *Transaction) Commit() error {
+	if tx.done {
+		return utils.ErrTransactionDone
+	}
+	tx.done = true
+	if tx.writes.Len() == 0 {
+		tx.release()
+		return nil
+	}
+
+	lsn, err := tx.ds.write(tx.writes, tx.validate)
+	tx.release()
+	if err != nil {
+		return err
+	}
+	return tx.ds.writeAheadLog.waitUntilDurable(lsn)
+}
+
+// Rollback throws away the buffered writes and ends the transaction
+func (tx *Transaction) Rollback() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	tx.writes.Reset()
+	clear(tx.pending)
+	tx.release()
+}
+
+func (tx *Transaction) release() {
+	tx.ds.mu.Lock()
+	defer tx.ds.mu.Unlock()
+
+	tx.ds.snapshots.release(tx.snapshotSeq)
+}
+
+// validate checks none of the keys the transaction read or wrote were written by anyone else since the snapshot. Runs
+// under the store's mu, right before the writes are applied, so no other write can get in between.
+func (tx *Transaction) validate() error {
+	// * every write since the snapshot replaced a version the snapshot might need, so it was kept track of, even if
+	// * compaction has since dropped the write itself
+	for key := range tx.reads {
+		if tx.ds.writtenSince(key, tx.snapshotSeq) {
+			return fmt.Errorf("%w: %s", utils.ErrTransactionConflict, key)
+		}
+	}
+	for key := range tx.pending {
+		if tx.ds.writtenSince(key, tx.snapshotSeq) {
+			return fmt.Errorf("%w: %s", utils.ErrTransactionConflict, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/tferdous17/genesis/utils"
+)
+
+func TestTransaction_CommitAndConflicts(t *testing.T) {
+	store, err := openStore(t.TempDir(), t.TempDir(), asyncStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(key string, val string) {
+		if err := store.Put(&key, &val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("alice", "100")
+	put("bob", "0")
+
+	// * the transaction sees its own writes, and nobody else does until it commits
+	tx := beginTransaction(t, store)
+	if err := tx.Put("alice", "70"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put("bob", "30"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := tx.Get("alice"); err != nil || val != "70" {
+		t.Fatalf("expected the transaction to read its own write alice = 70, got %q (err = %v)", val, err)
+	}
+	if val, err := store.Get("alice"); err != nil || val != "100" {
+		t.Fatalf("expected alice = 100 before the commit, got %q (err = %v)", val, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := store.Get("bob"); err != nil || val != "30" {
+		t.Fatalf("expected bob = 30 after the commit, got %q (err = %v)", val, err)
+	}
+	if err := tx.Put("bob", "0"); !errors.Is(err, utils.ErrTransactionDone) {
+		t.Fatalf("expected ErrTransactionDone, got %v", err)
+	}
+
+	tests := []struct {
+		name string
+		run  func(tx *Transaction) error
+	}{
+		{"read key written since", func(tx *Transaction) error {
+			if _, err := tx.Get("alice"); err != nil {
+				return err
+			}
+			put("alice", "0")
+			return tx.Put("bob", "100")
+		}},
+		{"missing key written since", func(tx *Transaction) error {
+			if _, err := tx.Get("carol"); !errors.Is(err, utils.ErrKeyNotFound) {
+				return fmt.Errorf("expected carol to be missing, got %v", err)
+			}
+			put("carol", "50")
+			return tx.Put("bob", "100")
+		}},
+		{"blind write to key written since", func(tx *Transaction) error {
+			put("dave", "10")
+			return tx.Put("dave", "20")
+		}},
+	}
+	for _, tt := range tests {
+		tx := beginTransaction(t, store)
+		if err := tt.run(tx); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := tx.Commit(); !errors.Is(err, utils.ErrTransactionConflict) {
+			t.Fatalf("%s: expected ErrTransactionConflict, got %v", tt.name, err)
+		}
+		if val, err := store.Get("bob"); err != nil || val != "30" {
+			t.Fatalf("%s: expected the conflicting transaction to leave bob = 30, got %q (err = %v)", tt.name, val, err)
+		}
+	}
+
+	// * a key written since the snapshot is still read at the version the snapshot saw
+	tx = beginTransaction(t, store)
+	put("bob", "40")
+	if val, err := tx.Get("bob"); err != nil || val != "30" {
+		t.Fatalf("expected the snapshot's bob = 30, got %q (err = %v)", val, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("expected a read-only transaction to commit, got %v", err)
+	}
+	if len(store.snapshots.open) != 0 || len(store.snapshots.replaced) != 0 {
+		t.Fatalf("expected every snapshot and replaced version to be released, got %v and %v", store.snapshots.open, store.snapshots.replaced)
+	}
+}
+
+func TestTransaction_SnapshotOutlivesCompaction(t *testing.T) {
+	opts := asyncStoreOptions()
+	opts.TombstoneGracePeriod = 0
+	store, err := openStore(t.TempDir(), t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flush := func(key string, val string, deleted bool) {
+		if deleted {
+			err = store.Delete(key)
+		} else {
+			err = store.Put(&key, &val)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.FlushMemtable(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// * delete the key after the snapshot, then compact every version of it (tombstone included) away
+	flush("alice", "100", false)
+	tx := beginTransaction(t, store)
+	older := beginTransaction(t, store)
+	flush("alice", "", true)
+	flush("bob", "0", false)
+	flush("carol", "0", false)
+	store.bucketManager.waitForCompactions()
+	store.mu.Lock()
+	record, err := store.newestRecord("alice")
+	store.mu.Unlock()
+	if err != nil || record != nil {
+		t.Fatalf("expected compaction to drop every version of alice, got %+v (err = %v)", record, err)
+	}
+
+	if val, err := tx.Get("alice"); err != nil || val != "100" {
+		t.Fatalf("expected the snapshot's alice = 100, got %q (err = %v)", val, err)
+	}
+	if err := tx.Put("alice", "50"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, utils.ErrTransactionConflict) {
+		t.Fatalf("expected ErrTransactionConflict, got %v", err)
+	}
+
+	// * the other transaction still needs the version, until it ends too
+	if val, err := older.Get("alice"); err != nil || val != "100" {
+		t.Fatalf("expected the snapshot's alice = 100, got %q (err = %v)", val, err)
+	}
+	older.Rollback()
+	if len(store.snapshots.replaced) != 0 {
+		t.Fatalf("expected every replaced version to be released, got %v", store.snapshots.replaced)
+	}
+}
+
+func TestTransaction_ConcurrentTransfersKeepTotal(t *testing.T) {
+	store, err := openStore(t.TempDir(), t.TempDir(), asyncStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const accounts, workers, transfers = 5, 6, 40
+	for i := 0; i < accounts; i++ {
+		key, val := fmt.Sprintf("account%d", i), "100"
+		if err := store.Put(&key, &val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// * every transfer moves 1 between two random accounts and is retried until it commits without a conflict
+	transfer := func(rng *rand.Rand) error {
+		from, to := fmt.Sprintf("account%d", rng.Intn(accounts)), fmt.Sprintf("account%d", rng.Intn(accounts))
+		for {
+			tx, err := store.Begin()
+			if err != nil {
+				return err
+			}
+			err = func() error {
+				fromVal, err := tx.Get(from)
+				if err != nil {
+					return err
+				}
+				toVal, err := tx.Get(to)
+				if err != nil {
+					return err
+				}
+				fromBalance, _ := strconv.Atoi(fromVal)
+				toBalance, _ := strconv.Atoi(toVal)
+				if err := tx.Put(from, strconv.Itoa(fromBalance-1)); err != nil {
+					return err
+				}
+				// * a transfer to the same account reads its own write, so it nets out
+				if from == to {
+					toBalance--
+				}
+				if err := tx.Put(to, strconv.Itoa(toBalance+1)); err != nil {
+					return err
+				}
+				return tx.Commit()
+			}()
+			if errors.Is(err, utils.ErrTransactionConflict) {
+				tx.Rollback()
+				continue
+			}
+			return err
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for i := 0; i < transfers; i++ {
+				if err := transfer(rng); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for i := 0; i < accounts; i++ {
+		val, err := store.Get(fmt.Sprintf("account%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		balance, _ := strconv.Atoi(val)
+		total += balance
+	}
+	if total != accounts*100 {
+		t.Fatalf("expected the balances to still add up to %d, got %d", accounts*100, total)
+	}
+}
+
+func beginTransaction(t *testing.T, store *DiskStore) *Transaction {
+	t.Helper()
+	tx, err := store.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
@@ -2,18 +2,174 @@ package store
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/tferdous17/genesis/utils"
 )
 
+/*
+Every WAL entry is written as a frame (see frame.go) with the following payload:
+
+| Operation | Header | Key | Value |
+
+except for a write batch, which logs all of its operations in a single frame, so they're either all replayed or none
+are:
+
+| BATCH | Count | (Operation | Header | Key | Value)... |
+*/
+
 const WALBatchThreshold = 1024 * 1024 * 3
 
-// writeAheadLog maintains the log and batches operations to minimize disk writes
+const (
+	walSegmentPrefix    = "genesis_wal-"
+	walSegmentExtension = ".log"
+)
+
+// writeAheadLog maintains the log and batches operations to minimize disk writes.
+// The log is split into numbered segments, and a new segment is started every time the memtable rotates. Once the
+// rotated memtable is flushed to an SSTable, every segment up to and including the one it sealed can be deleted.
+//
+// Every appended operation is assigned a log sequence number (LSN), and writers wait on that LSN until the
+// configured durability mode considers it safe.
 type writeAheadLog struct {
-	file     *os.File
-	opsBatch []byte
-	size     int
+	// fileMu serializes writing, syncing and rotating the segment files, always acquired before mu
+	fileMu     sync.Mutex
+	directory  string
+	file       *os.File // currently active segment
+	segmentNum uint64
+
+	// mu guards the pending batch and LSN counters
+	mu          sync.Mutex
+	cond        *sync.Cond
+	opsBatch    []byte
+	size        int
+	appendedLSN uint64
+	syncedLSN   uint64
+
+	durability          WALDurability
+	groupCommitInterval time.Duration
+	groupCommitSize     int
+	groupLeader         bool          // whether a writer is currently holding a group commit open
+	groupFull           chan struct{} // cuts the group commit window short once groupCommitSize is reached
+}
+
+// openWAL opens the log in directory and starts a fresh segment after any existing ones, which are left in place
+// so they can be replayed.
+func openWAL(directory string, opts StoreOptions) (*writeAheadLog, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	segments, err := listWALSegments(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &writeAheadLog{
+		directory:           directory,
+		durability:          opts.Durability,
+		groupCommitInterval: opts.GroupCommitInterval,
+		groupCommitSize:     opts.GroupCommitSize,
+		groupFull:           make(chan struct{}, 1),
+	}
+	w.cond = sync.NewCond(&w.mu)
+	if len(segments) > 0 {
+		w.segmentNum = segments[len(segments)-1]
+	}
+	if err := w.openNextSegment(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *writeAheadLog) openNextSegment() error {
+	file, err := os.OpenFile(walSegmentFilename(w.directory, w.segmentNum+1), os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.segmentNum++
+	return nil
+}
+
+// rotate seals the active segment and starts writing to a new one. Returns the number of the sealed segment, which
+// holds (along with every segment before it) all operations applied to the memtable being rotated out.
+func (w *writeAheadLog) rotate() (uint64, error) {
+	w.fileMu.Lock()
+	defer w.fileMu.Unlock()
+
+	if err := w.flushLocked(); err != nil {
+		return 0, err
+	}
+	if err := w.file.Close(); err != nil {
+		return 0, err
+	}
+
+	sealed := w.segmentNum
+	if err := w.openNextSegment(); err != nil {
+		return 0, err
+	}
+	return sealed, nil
+}
+
+// releaseSegments deletes every sealed segment up to and including upTo, should only be called once all the
+// operations they hold are persisted in an SSTable
+func (w *writeAheadLog) releaseSegments(upTo uint64) error {
+	w.fileMu.Lock()
+	defer w.fileMu.Unlock()
+
+	segments, err := listWALSegments(w.directory)
+	if err != nil {
+		return err
+	}
+
+	for _, segmentNum := range segments {
+		if segmentNum > upTo || segmentNum == w.segmentNum {
+			continue
+		}
+		if err := os.Remove(walSegmentFilename(w.directory, segmentNum)); err != nil {
+			return err
+		}
+		utils.Logf("WAL: released segment %d", segmentNum)
+	}
+	return nil
+}
+
+func walSegmentFilename(directory string, segmentNum uint64) string {
+	return filepath.Join(directory, fmt.Sprintf("%s%06d%s", walSegmentPrefix, segmentNum, walSegmentExtension))
+}
+
+// listWALSegments returns the numbers of every segment in directory in ascending order
+func listWALSegments(directory string) ([]uint64, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, walSegmentPrefix) || !strings.HasSuffix(name, walSegmentExtension) {
+			continue
+		}
+		var segmentNum uint64
+		if _, err := fmt.Sscanf(name, walSegmentPrefix+"%d"+walSegmentExtension, &segmentNum); err != nil {
+			continue
+		}
+		segments = append(segments, segmentNum)
+	}
+	slices.Sort(segments)
+
+	return segments, nil
 }
 
 func (w *writeAheadLog) clearBatch() {
@@ -21,33 +177,289 @@ func (w *writeAheadLog) clearBatch() {
 	w.size = 0
 }
 
-func (w *writeAheadLog) appendWALOperation(op Operation, record *Record) error {
-	buf := new(bytes.Buffer)
-	// Store operation as only 1 byte (only WAL entries will have this extra byte)
-	buf.WriteByte(byte(op))
+// appendWALOperation queues up an operation and returns its LSN. The operation isn't guaranteed to be on disk
+// until waitUntilDurable(lsn) returns.
+func (w *writeAheadLog) appendWALOperation(op Operation, record *Record) (uint64, error) {
+	frame, err := encodeWALFrame(op, record)
+	if err != nil {
+		return 0, err
+	}
+	return w.appendFrame(frame)
+}
 
-	// encode the entire key, value entry
-	if encodeErr := record.EncodeKV(buf); encodeErr != nil {
-		return utils.ErrEncodingKVFailed
+// appendWALBatch queues up every operation of a write batch as a single entry and returns its LSN
+func (w *writeAheadLog) appendWALBatch(ops []walOperation) (uint64, error) {
+	frame, err := encodeWALBatchFrame(ops)
+	if err != nil {
+		return 0, err
 	}
+	return w.appendFrame(frame)
+}
 
+func (w *writeAheadLog) appendFrame(frame []byte) (uint64, error) {
 	// store in the batch
-	w.opsBatch = append(w.opsBatch, buf.Bytes()...)
-	w.size += len(buf.Bytes())
+	w.mu.Lock()
+	w.opsBatch = append(w.opsBatch, frame...)
+	w.size += len(frame)
+	w.appendedLSN++
+	lsn, size := w.appendedLSN, w.size
+	w.mu.Unlock()
+
+	if w.durability == Async && size >= WALBatchThreshold {
+		return lsn, w.flushToDisk()
+	}
+	if w.durability == GroupCommit && size >= w.groupCommitSize {
+		select {
+		case w.groupFull <- struct{}{}:
+		default:
+		}
+	}
+
+	return lsn, nil
+}
 
-	if w.size >= WALBatchThreshold {
+// waitUntilDurable blocks until the operation at lsn is as durable as the configured mode guarantees
+func (w *writeAheadLog) waitUntilDurable(lsn uint64) error {
+	switch w.durability {
+	case SyncEveryWrite:
+		w.mu.Lock()
+		synced := w.syncedLSN >= lsn
+		w.mu.Unlock()
+		if synced {
+			return nil
+		}
 		return w.flushToDisk()
+	case GroupCommit:
+		return w.groupCommit(lsn)
+	default:
+		return nil
 	}
+}
+
+// groupCommit makes the first waiting writer the leader of a group, which keeps the group open for a short window
+// so concurrent writers can join, then syncs once for all of them. Everyone else just waits for the leader.
+func (w *writeAheadLog) groupCommit(lsn uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.syncedLSN < lsn {
+		if w.groupLeader {
+			w.cond.Wait()
+			continue
+		}
+
+		w.groupLeader = true
+		windowOpen := w.size < w.groupCommitSize
+		w.mu.Unlock()
 
+		if windowOpen {
+			select {
+			case <-time.After(w.groupCommitInterval):
+			case <-w.groupFull:
+			}
+		}
+		err := w.flushToDisk()
+
+		w.mu.Lock()
+		w.groupLeader = false
+		w.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// Flushes the current batch of operations to disk, only called if size reaches WALBatchThreshold
+// flushToDisk writes out and fsyncs every operation appended so far
 func (w *writeAheadLog) flushToDisk() error {
-	if logErr := utils.WriteToFile(w.opsBatch, w.file); logErr != nil {
-		return logErr
-	}
+	w.fileMu.Lock()
+	defer w.fileMu.Unlock()
+
+	return w.flushLocked()
+}
 
+// flushLocked does the actual flush, the caller must hold fileMu
+func (w *writeAheadLog) flushLocked() error {
+	w.mu.Lock()
+	batch, upTo := w.opsBatch, w.appendedLSN
 	w.clearBatch()
+	w.mu.Unlock()
+
+	if len(batch) > 0 {
+		if logErr := utils.WriteToFile(batch, w.file); logErr != nil {
+			return logErr
+		}
+	}
+
+	w.mu.Lock()
+	if upTo > w.syncedLSN {
+		w.syncedLSN = upTo
+	}
+	w.cond.Broadcast()
+	w.mu.Unlock()
 	return nil
 }
+
+// close flushes anything still pending and closes the active segment
+func (w *writeAheadLog) close() error {
+	w.fileMu.Lock()
+	defer w.fileMu.Unlock()
+
+	if err := w.flushLocked(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// replay decodes every entry in every segment, oldest first, and passes it to apply in the order it was written.
+// Returns the number of entries decoded.
+func (w *writeAheadLog) replay(apply func(op Operation, record *Record)) (int, error) {
+	segments, err := listWALSegments(w.directory)
+	if err != nil {
+		return 0, err
+	}
+
+	var numEntries int
+	for _, segmentNum := range segments {
+		n, err := replaySegment(walSegmentFilename(w.directory, segmentNum), apply)
+		numEntries += n
+		if err != nil {
+			return numEntries, err
+		}
+	}
+	return numEntries, nil
+}
+
+// replaySegment replays a single segment file.
+//
+// A frame that runs past the end of the file, or the final frame failing its CRC, means the process died mid-write
+// (a torn write). Nothing after it was ever acknowledged, so the file is cut back to the last good frame and replay
+// ends cleanly. A CRC failure anywhere else means the log itself is corrupted, which is reported along with the offset.
+func replaySegment(filename string, apply func(op Operation, record *Record)) (int, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+
+	var numEntries int
+	offset := 0
+	for offset < len(data) {
+		ops, frameSize, err := decodeWALFrame(data[offset:])
+		if errors.Is(err, errTornWrite) {
+			utils.LogYELLOW("WAL: torn write at offset %d, discarding tail", offset)
+			return numEntries, os.Truncate(filename, int64(offset))
+		}
+		if err != nil {
+			return numEntries, fmt.Errorf("%w: %s at offset %d: %w", utils.ErrWALCorrupted, filename, offset, err)
+		}
+
+		for _, op := range ops {
+			apply(op.op, op.record)
+			numEntries++
+		}
+		offset += frameSize
+	}
+
+	return numEntries, nil
+}
+
+// walOperation is a single operation logged in the WAL
+type walOperation struct {
+	op     Operation
+	record *Record
+}
+
+func encodeWALFrame(op Operation, record *Record) ([]byte, error) {
+	payload := new(bytes.Buffer)
+	// Store operation as only 1 byte (only WAL entries will have this extra byte)
+	payload.WriteByte(byte(op))
+
+	// encode the entire key, value entry
+	if encodeErr := record.EncodeKV(payload); encodeErr != nil {
+		return nil, utils.ErrEncodingKVFailed
+	}
+
+	return encodeFrame(payload.Bytes()), nil
+}
+
+func encodeWALBatchFrame(ops []walOperation) ([]byte, error) {
+	payload := new(bytes.Buffer)
+	payload.WriteByte(byte(BATCH))
+	_ = binary.Write(payload, binary.LittleEndian, uint32(len(ops)))
+	for _, op := range ops {
+		payload.WriteByte(byte(op.op))
+		if encodeErr := op.record.EncodeKV(payload); encodeErr != nil {
+			return nil, utils.ErrEncodingKVFailed
+		}
+	}
+
+	return encodeFrame(payload.Bytes()), nil
+}
+
+// decodeWALFrame decodes the frame at the start of buf, which runs to the end of the segment, into the operations it
+// logged (several for a write batch). Returns errTornWrite if the frame looks like an interrupted final write.
+func decodeWALFrame(buf []byte) ([]walOperation, int, error) {
+	payload, frameSize, err := decodeFrame(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(payload) == 0 {
+		return nil, 0, utils.ErrDecodingHeaderFailed
+	}
+
+	if Operation(payload[0]) != BATCH {
+		op, n, err := decodeWALOperation(payload)
+		if err != nil {
+			return nil, 0, err
+		}
+		if n != len(payload) {
+			return nil, 0, utils.ErrDecodingKVFailed
+		}
+		return []walOperation{op}, frameSize, nil
+	}
+
+	if len(payload) < 5 {
+		return nil, 0, utils.ErrDecodingHeaderFailed
+	}
+	count := binary.LittleEndian.Uint32(payload[1:5])
+	ops := make([]walOperation, 0, count)
+	offset := 5
+	for range count {
+		op, n, err := decodeWALOperation(payload[offset:])
+		if err != nil {
+			return nil, 0, err
+		}
+		ops = append(ops, op)
+		offset += n
+	}
+	if offset != len(payload) {
+		return nil, 0, utils.ErrDecodingKVFailed
+	}
+	return ops, frameSize, nil
+}
+
+// decodeWALOperation decodes the single operation at the start of buf and returns it along with its size
+func decodeWALOperation(buf []byte) (walOperation, int, error) {
+	if len(buf) < 1+headerSize {
+		return walOperation{}, 0, utils.ErrDecodingHeaderFailed
+	}
+	op := Operation(buf[0])
+	if op != PUT && op != GET && op != DELETE {
+		return walOperation{}, 0, fmt.Errorf("unknown operation %d", op)
+	}
+
+	record := &Record{}
+	header, err := NewHeader(buf[1 : 1+headerSize])
+	if err != nil {
+		return walOperation{}, 0, utils.ErrDecodingKVFailed
+	}
+	size := 1 + headerSize + int(header.KeySize) + int(header.ValueSize)
+	if size > len(buf) {
+		return walOperation{}, 0, utils.ErrDecodingKVFailed
+	}
+	if err := record.DecodeKV(buf[1:size]); err != nil {
+		return walOperation{}, 0, utils.ErrDecodingKVFailed
+	}
+
+	return walOperation{op: op, record: record}, size, nil
+}
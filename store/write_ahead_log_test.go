@@ -0,0 +1,224 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tferdous17/genesis/utils"
+)
+
+func TestDiskStore_RecoverFromWAL(t *testing.T) {
+	logDir, storageDir := t.TempDir(), t.TempDir()
+
+	store, err := openStore(logDir, storageDir, DefaultStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range [][2]string{{"user1", "batman"}, {"user2", "superman"}, {"user1", "robin"}} {
+		if err := store.Put(&kv[0], &kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete("user2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.writeAheadLog.flushToDisk(); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := openStore(logDir, storageDir, DefaultStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	val, err := recovered.memtable.Get(ptr("user1"))
+	if err != nil || val.Value != "robin" {
+		t.Fatalf("expected user1 = robin, got %q (err = %v)", val.Value, err)
+	}
+	deleted, err := recovered.memtable.Get(ptr("user2"))
+	if err != nil || deleted.Header.Tombstone != 1 {
+		t.Fatalf("expected user2 to be a tombstone, got %+v (err = %v)", deleted, err)
+	}
+}
+
+func TestDiskStore_RecoverFromWALTruncatedTail(t *testing.T) {
+	logDir, storageDir := t.TempDir(), t.TempDir()
+
+	store, err := openStore(logDir, storageDir, DefaultStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key1, key2, val := "user1", "user2", "batman"
+	if err := store.Put(&key1, &val); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(&key2, &val); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.writeAheadLog.flushToDisk(); err != nil {
+		t.Fatal(err)
+	}
+
+	// chop the last few bytes off to simulate a crash mid-write
+	logPath := walSegmentFilename(logDir, store.writeAheadLog.segmentNum)
+	info, err := os.Stat(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(logPath, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := openStore(logDir, storageDir, DefaultStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := recovered.memtable.Get(&key1); err != nil || val.Value != "batman" {
+		t.Fatalf("expected user1 = batman to be recovered, got %q (err = %v)", val.Value, err)
+	}
+	if _, err := recovered.memtable.Get(&key2); !errors.Is(err, utils.ErrKeyNotFound) {
+		t.Fatalf("expected truncated key to be missing, got err = %v", err)
+	}
+}
+
+func TestDiskStore_RecoverFromWALCorruption(t *testing.T) {
+	logDir, storageDir := t.TempDir(), t.TempDir()
+
+	store, err := openStore(logDir, storageDir, DefaultStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"user1", "user2", "user3"} {
+		val := "batman"
+		if err := store.Put(&key, &val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logPath := walSegmentFilename(logDir, store.writeAheadLog.segmentNum)
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frameSize := len(data) / 3
+
+	// flipping a byte in the last frame is indistinguishable from a torn write, so it just gets dropped
+	tornTail := slices.Clone(data)
+	tornTail[len(tornTail)-1] ^= 0xFF
+	if err := os.WriteFile(logPath, tornTail, 0666); err != nil {
+		t.Fatal(err)
+	}
+	n, err := replaySegment(logPath, func(Operation, *Record) {})
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 operations replayed from a torn tail, got %d (err = %v)", n, err)
+	}
+
+	// flipping a byte in the middle frame is real corruption and must fail loudly, whether it's in the payload or in
+	// the length (which would otherwise look like a frame running past the end of the log)
+	for name, at := range map[string]int{"payload": frameSize + frameHeaderSize + 2, "length": frameSize + 2} {
+		corrupted := slices.Clone(data)
+		corrupted[at] ^= 0xFF
+		if err := os.WriteFile(logPath, corrupted, 0666); err != nil {
+			t.Fatal(err)
+		}
+		_, err = openStore(logDir, storageDir, DefaultStoreOptions())
+		if !errors.Is(err, utils.ErrWALCorrupted) {
+			t.Fatalf("%s: expected ErrWALCorrupted, got %v", name, err)
+		}
+		if !strings.Contains(err.Error(), fmt.Sprintf("offset %d", frameSize)) {
+			t.Fatalf("%s: expected error to name offset %d, got %v", name, frameSize, err)
+		}
+	}
+}
+
+func TestWriteAheadLog_RotateAndRelease(t *testing.T) {
+	logDir := t.TempDir()
+
+	wal, err := openWAL(logDir, DefaultStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := &Record{Header: Header{KeySize: 4, ValueSize: 3}, Key: "key1", Value: "val", RecordSize: headerSize + 7}
+	if _, err := wal.appendWALOperation(PUT, record); err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := wal.rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed != 1 || wal.segmentNum != 2 {
+		t.Fatalf("expected to seal segment 1 and start segment 2, got %d and %d", sealed, wal.segmentNum)
+	}
+	if _, err := wal.appendWALOperation(DELETE, record); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.flushToDisk(); err != nil {
+		t.Fatal(err)
+	}
+
+	// both segments should replay, oldest first
+	var ops []Operation
+	if _, err := wal.replay(func(op Operation, _ *Record) { ops = append(ops, op) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 2 || ops[0] != PUT || ops[1] != DELETE {
+		t.Fatalf("expected [PUT DELETE], got %v", ops)
+	}
+
+	if err := wal.releaseSegments(sealed); err != nil {
+		t.Fatal(err)
+	}
+	segments, err := listWALSegments(logDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 || segments[0] != 2 {
+		t.Fatalf("expected only the active segment to remain, got %v", segments)
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
+
+func TestDiskStore_DurabilityModes(t *testing.T) {
+	for _, durability := range []WALDurability{SyncEveryWrite, GroupCommit} {
+		t.Run(durability.String(), func(t *testing.T) {
+			logDir, storageDir := t.TempDir(), t.TempDir()
+			opts := DefaultStoreOptions()
+			opts.Durability = durability
+
+			store, err := openStore(logDir, storageDir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// concurrent writers, every one of them must be on disk once Put returns
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					key, val := fmt.Sprintf("user%d", i), "batman"
+					if err := store.Put(&key, &val); err != nil {
+						t.Error(err)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			n, err := replaySegment(walSegmentFilename(logDir, store.writeAheadLog.segmentNum), func(Operation, *Record) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 20 {
+				t.Fatalf("expected 20 durable operations, got %d", n)
+			}
+		})
+	}
+}
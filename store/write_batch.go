@@ -0,0 +1,133 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tferdous17/genesis/utils"
+)
+
+// WriteBatch collects puts and deletes to be applied to a store together by DiskStore.Write. The batch is logged as a
+// single WAL entry and applied to the memtable in one go, so readers (and recovery after a crash) see either every
+// mutation in it or none of them. Later mutations of the same key win.
+//
+//	batch := store.NewWriteBatch()
+//	batch.Put("user1", "batman")
+//	batch.Delete("user2")
+//	err := ds.Write(batch)
+type WriteBatch struct {
+	entries []batchEntry
+}
+
+type batchEntry struct {
+	op    Operation
+	key   string
+	value string
+	ttl   time.Duration // 0 for a put that never expires
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put adds a write of key, value to the batch
+func (b *WriteBatch) Put(key string, value string) {
+	b.entries = append(b.entries, batchEntry{op: PUT, key: key, value: value})
+}
+
+// PutWithTTL adds a write of key, value to the batch that expires after ttl, counted from when the batch is written
+func (b *WriteBatch) PutWithTTL(key string, value string, ttl time.Duration) {
+	if ttl <= 0 {
+		// * kept so Write rejects it, rather than silently writing a key that never expires
+		ttl = -1
+	}
+	b.entries = append(b.entries, batchEntry{op: PUT, key: key, value: value, ttl: ttl})
+}
+
+// Delete adds a delete of key to the batch
+func (b *WriteBatch) Delete(key string) {
+	b.entries = append(b.entries, batchEntry{op: DELETE, key: key})
+}
+
+// Len returns the number of mutations in the batch
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+// Reset empties the batch so it can be reused
+func (b *WriteBatch) Reset() {
+	b.entries = b.entries[:0]
+}
+
+// Write atomically applies every mutation in the batch, and only returns once it's as durable as the store's
+// WALDurability requires. If any mutation is invalid, nothing is applied.
+func (ds *DiskStore) Write(batch *WriteBatch) error {
+	if ds == nil {
+		return fmt.Errorf("disk store is not initialized")
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	lsn, err := ds.write(batch, nil)
+	if err != nil {
+		return err
+	}
+	return ds.writeAheadLog.waitUntilDurable(lsn)
+}
+
+// write applies the batch to the WAL and memtable and returns the WAL LSN to wait on. If check isn't nil, it's called
+// under mu right before the batch is applied and can veto it by returning an error.
+func (ds *DiskStore) write(batch *WriteBatch, check func() error) (uint64, error) {
+	// * validate everything before handing out any sequence numbers, so a bad batch leaves no trace
+	expiries := make([]uint32, len(batch.entries))
+	for i, entry := range batch.entries {
+		var err error
+		if entry.op == DELETE {
+			if entry.key == "" {
+				err = utils.ErrEmptyKey
+			}
+		} else {
+			err = utils.ValidateKV(&entry.key, &entry.value)
+			if err == nil && entry.ttl != 0 {
+				expiries[i], err = expiryFromTTL(entry.ttl)
+			}
+		}
+		if err != nil {
+			return 0, fmt.Errorf("batch entry %d (%s): %w", i, entry.key, err)
+		}
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.closed {
+		return 0, utils.ErrStoreClosed
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			return 0, err
+		}
+	}
+
+	ops := make([]walOperation, 0, len(batch.entries))
+	for i, entry := range batch.entries {
+		record, err := ds.newRecord(entry.op, entry.key, entry.value, expiries[i])
+		if err != nil {
+			return 0, err
+		}
+		ops = append(ops, walOperation{op: entry.op, record: record})
+	}
+
+	lsn, err := ds.writeAheadLog.appendWALBatch(ops)
+	if err != nil {
+		return 0, err
+	}
+	// * the whole batch lands in the memtable before mu is released, and any rotation only happens after, so it can
+	// * never be split across memtables (or WAL segments)
+	for _, op := range ops {
+		ds.memtable.Put(&op.record.Key, op.record)
+	}
+
+	return lsn, ds.flushIfThresholdReached()
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/tferdous17/genesis/utils"
+)
+
+func TestDiskStore_WriteBatch(t *testing.T) {
+	store, err := openStore(t.TempDir(), t.TempDir(), DefaultStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range [][2]string{{"user1", "batman"}, {"user2", "superman"}} {
+		if err := store.Put(&kv[0], &kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batch := NewWriteBatch()
+	batch.Put("user1", "robin")
+	batch.Delete("user2")
+	batch.Put("user3", "thor")
+	batch.Put("user3", "loki")
+	if err := store.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"user1": "robin", "user3": "loki"} {
+		if val, err := store.Get(key); err != nil || val != want {
+			t.Fatalf("expected %s = %s, got %q (err = %v)", key, want, val, err)
+		}
+	}
+	if val, err := store.Get("user2"); !errors.Is(err, utils.ErrKeyNotFound) {
+		t.Fatalf("expected user2 to be deleted, got %q (err = %v)", val, err)
+	}
+
+	// * one bad entry keeps the whole batch out
+	seqNum := store.seqNum
+	batch.Reset()
+	batch.Put("user4", "hulk")
+	batch.Put("user5", "")
+	if err := store.Write(batch); !errors.Is(err, utils.ErrEmptyValue) {
+		t.Fatalf("expected ErrEmptyValue, got %v", err)
+	}
+	if val, err := store.Get("user4"); !errors.Is(err, utils.ErrKeyNotFound) {
+		t.Fatalf("expected user4 to be left out, got %q (err = %v)", val, err)
+	}
+	if store.seqNum != seqNum {
+		t.Fatalf("expected a rejected batch to use no sequence numbers, went from %d to %d", seqNum, store.seqNum)
+	}
+}
+
+func TestDiskStore_WriteBatchRecoversAllOrNothing(t *testing.T) {
+	logDir, storageDir := t.TempDir(), t.TempDir()
+	store, err := openStore(logDir, storageDir, DefaultStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, val := "user0", "batman"
+	if err := store.Put(&key, &val); err != nil {
+		t.Fatal(err)
+	}
+	batch := NewWriteBatch()
+	for i := 1; i <= 3; i++ {
+		batch.Put(fmt.Sprintf("user%d", i), fmt.Sprintf("hero%d", i))
+	}
+	if err := store.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	logPath := walSegmentFilename(logDir, store.writeAheadLog.segmentNum)
+	if n, err := replaySegment(logPath, func(Operation, *Record) {}); err != nil || n != 4 {
+		t.Fatalf("expected 4 operations replayed, got %d (err = %v)", n, err)
+	}
+
+	// * cutting into the batch's entry loses all of it, even the operations that made it to disk whole
+	info, err := os.Stat(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(logPath, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := openStore(logDir, storageDir, DefaultStoreOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := recovered.Get("user0"); err != nil || val != "batman" {
+		t.Fatalf("expected user0 = batman, got %q (err = %v)", val, err)
+	}
+	for i := 1; i <= 3; i++ {
+		key := fmt.Sprintf("user%d", i)
+		if val, err := recovered.Get(key); !errors.Is(err, utils.ErrKeyNotFound) {
+			t.Fatalf("expected %s to be lost along with the rest of the batch, got %q (err = %v)", key, val, err)
+		}
+	}
+}
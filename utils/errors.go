@@ -7,8 +7,12 @@ var (
 	ErrDuplicateKey = errors.New("invalid key: already in store")
 	ErrKeyNotFound  = errors.New("invalid key: not found or deleted")
 
+	ErrConditionFailed = errors.New("condition failed: key is not at the expected version")
+
 	ErrEmptyValue = errors.New("invalid value: value can not be empty")
 
+	ErrInvalidTTL = errors.New("invalid ttl: must be positive")
+
 	ErrFileInit = errors.New("error initializing file")
 
 	ErrEncodingHeaderFailed = errors.New("encoding fail: failed to encode header")
@@ -19,5 +23,17 @@ var (
 
 	ErrMemtableLocked = errors.New("memtable fail: currently locked for further operations")
 
-	ErrKeyNotWithinTable = errors.New("sstable: key not within table's range")
+	ErrStoreClosed = errors.New("store: already closed")
+
+	ErrTransactionConflict = errors.New("transaction: key was written since the snapshot")
+	ErrTransactionDone     = errors.New("transaction: already committed or rolled back")
+
+	ErrKeyNotWithinTable         = errors.New("sstable: key not within table's range")
+	ErrSSTableCorrupted          = errors.New("sstable: corrupted")
+	ErrUnsupportedSSTableVersion = errors.New("sstable: unsupported format version")
+
+	ErrWALCorrupted = errors.New("wal: corrupted entry")
+
+	ErrManifestCorrupted          = errors.New("manifest: corrupted")
+	ErrUnsupportedManifestVersion = errors.New("manifest: unsupported version")
 )